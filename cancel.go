@@ -0,0 +1,136 @@
+package natshttp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// cancelSubjectPrefix is the prefix of the subjects clients cancel requests on. A Server subscribes to every subject
+// under it once, rather than to the subject announced with each request, so that a cancellation sent immediately after
+// a request cannot overtake the subscription for it.
+const cancelSubjectPrefix = "_NATSHTTP.CANCEL"
+
+const (
+	// earlyCancelTTL is how long a cancellation is remembered for a request which has not been registered yet. The
+	// request and its cancellation are received on different subscriptions, so either can be processed first.
+	earlyCancelTTL = time.Minute
+
+	// maxEarlyCancels bounds the number of cancellations which are remembered, beyond which the oldest is forgotten.
+	// Every Server receives the cancellations for requests handled by the others.
+	maxEarlyCancels = 4096
+)
+
+// newCancelSubject generates a unique subject for cancelling a request.
+func newCancelSubject(conn *nats.Conn) string {
+	inbox := conn.NewInbox()
+	return cancelSubjectPrefix + "." + inbox[strings.LastIndexByte(inbox, '.')+1:]
+}
+
+// isCancelSubject returns true if subject is a single token beneath cancelSubjectPrefix, without wildcards.
+func isCancelSubject(subject string) bool {
+	token, ok := strings.CutPrefix(subject, cancelSubjectPrefix+".")
+	return ok && token != "" && !strings.ContainsAny(token, ".*> \t\r\n")
+}
+
+// earlyCancel is a cancellation which was received before the request it is for was registered.
+type earlyCancel struct {
+	subject  string
+	received time.Time
+}
+
+// cancelMux owns a single wildcard subscription for cancellations and demultiplexes them to the requests being
+// handled, in a similar fashion to inboxMux. Cancellations for requests handled elsewhere expire after earlyCancelTTL.
+type cancelMux struct {
+	sub *nats.Subscription
+
+	lock    sync.Mutex
+	cancels map[string]context.CancelFunc
+
+	// early cancellations are kept in the order they were received, so those which have expired are at the front
+	early      map[string]struct{}
+	earlyQueue []earlyCancel
+}
+
+func newCancelMux(conn *nats.Conn) (*cancelMux, error) {
+	mux := &cancelMux{
+		cancels: make(map[string]context.CancelFunc),
+		early:   make(map[string]struct{}),
+	}
+
+	sub, err := conn.Subscribe(cancelSubjectPrefix+".*", mux.onMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the callback never blocks
+	if err = sub.SetPendingLimits(-1, -1); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	mux.sub = sub
+
+	return mux, nil
+}
+
+func (m *cancelMux) onMsg(msg *nats.Msg) {
+	now := time.Now()
+
+	m.lock.Lock()
+	cancel, ok := m.cancels[msg.Subject]
+	if _, seen := m.early[msg.Subject]; !ok && !seen {
+		m.expire(now)
+		m.early[msg.Subject] = struct{}{}
+		m.earlyQueue = append(m.earlyQueue, earlyCancel{subject: msg.Subject, received: now})
+	}
+	m.lock.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// expire forgets early cancellations which are older than earlyCancelTTL, along with the oldest if there is no room for
+// another. It must be called with the lock held.
+func (m *cancelMux) expire(now time.Time) {
+	for len(m.earlyQueue) > 0 {
+		oldest := m.earlyQueue[0]
+		if now.Sub(oldest.received) <= earlyCancelTTL && len(m.earlyQueue) < maxEarlyCancels {
+			return
+		}
+		// the request may have been registered since, in which case it has already been removed
+		delete(m.early, oldest.subject)
+		m.earlyQueue[0] = earlyCancel{}
+		m.earlyQueue = m.earlyQueue[1:]
+	}
+}
+
+// register invokes cancel if a cancellation is received on subject before the returned function has been called.
+func (m *cancelMux) register(subject string, cancel context.CancelFunc) (remove func()) {
+	m.lock.Lock()
+	_, cancelled := m.early[subject]
+	if cancelled {
+		delete(m.early, subject)
+	} else {
+		m.cancels[subject] = cancel
+	}
+	m.lock.Unlock()
+
+	if cancelled {
+		cancel()
+	}
+
+	return func() {
+		m.lock.Lock()
+		delete(m.cancels, subject)
+		m.lock.Unlock()
+	}
+}
+
+func (m *cancelMux) Close() error {
+	return m.sub.Unsubscribe()
+}
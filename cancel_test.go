@@ -0,0 +1,178 @@
+package natshttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancellation(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		ctxErr   error
+		writeErr error
+	}
+
+	results := make(chan result, 1)
+
+	routes := chi.NewRouter()
+	routes.Get("/wait", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		results <- result{ctxErr: r.Context().Err()}
+	})
+	routes.Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+		// stream until the client goes away
+		chunk := make([]byte, conn.MaxPayload())
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				results <- result{ctxErr: r.Context().Err(), writeErr: err}
+				return
+			}
+		}
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	transport := &Transport{Conn: conn}
+
+	awaitResult := func(t *testing.T) result {
+		select {
+		case res := <-results:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler was not cancelled")
+			return result{}
+		}
+	}
+
+	t.Run("awaiting response", func(t *testing.T) {
+		reqCtx, reqCancel := context.WithCancel(context.Background())
+		defer reqCancel()
+
+		go func() {
+			<-time.After(100 * time.Millisecond)
+			reqCancel()
+		}()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, "nats+http://"+subject+"/wait", nil)
+		assert.Nil(t, err)
+
+		_, err = transport.RoundTrip(req)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		assert.ErrorIs(t, awaitResult(t).ctxErr, context.Canceled)
+	})
+
+	t.Run("immediately", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			msg := nats.NewMsg(subject + ".wait.GET")
+			msg.Reply = conn.NewInbox()
+			msg.Header.Set(HeaderPath, "/wait")
+			msg.Header.Set(HeaderCancelSubject, newCancelSubject(conn))
+
+			// the cancellation is sent without waiting for the server to start handling the request
+			assert.Nil(t, conn.PublishMsg(msg))
+			assert.Nil(t, conn.Publish(msg.Header.Get(HeaderCancelSubject), nil))
+
+			assert.ErrorIs(t, awaitResult(t).ctxErr, context.Canceled)
+		}
+	})
+
+	t.Run("invalid subject", func(t *testing.T) {
+		for _, cancelSubject := range []string{">", "foo.bar", cancelSubjectPrefix + ".*", cancelSubjectPrefix + ".a.b"} {
+			msg := nats.NewMsg(subject + ".wait.GET")
+			msg.Header.Set(HeaderPath, "/wait")
+			msg.Header.Set(HeaderCancelSubject, cancelSubject)
+
+			// the server does not subscribe to subjects of the client's choosing
+			resp, err := conn.RequestMsg(msg, time.Second)
+			assert.Nil(t, err)
+			assert.Equal(t, "400", resp.Header.Get(HeaderStatusCode))
+			assert.Empty(t, results)
+		}
+	})
+
+	t.Run("streaming response", func(t *testing.T) {
+		reqCtx, reqCancel := context.WithCancel(context.Background())
+		defer reqCancel()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, "nats+http://"+subject+"/stream", nil)
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+
+		_, err = io.ReadFull(resp.Body, make([]byte, conn.MaxPayload()*2))
+		assert.Nil(t, err)
+
+		reqCancel()
+
+		res := awaitResult(t)
+		assert.ErrorIs(t, res.ctxErr, context.Canceled)
+		assert.ErrorIs(t, res.writeErr, context.Canceled)
+
+		_ = resp.Body.Close()
+	})
+
+	t.Run("closing body", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/stream", nil)
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+
+		_, err = io.ReadFull(resp.Body, make([]byte, conn.MaxPayload()))
+		assert.Nil(t, err)
+
+		// abandoning the body cancels the request
+		assert.Nil(t, resp.Body.Close())
+
+		assert.ErrorIs(t, awaitResult(t).ctxErr, context.Canceled)
+	})
+}
+
+func TestCancelMux_Early(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	as := assert.New(t)
+
+	mux, err := newCancelMux(conn)
+	as.Nil(err)
+	defer func() { _ = mux.Close() }()
+
+	// cancellations for requests handled elsewhere are remembered up to a limit
+	for i := 0; i < maxEarlyCancels*2; i++ {
+		mux.onMsg(nats.NewMsg(newCancelSubject(conn)))
+	}
+	as.Len(mux.early, maxEarlyCancels)
+	as.Len(mux.earlyQueue, maxEarlyCancels)
+
+	// a request cancelled before it is registered is cancelled upon registration
+	cancelSubject := newCancelSubject(conn)
+	mux.onMsg(nats.NewMsg(cancelSubject))
+
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	mux.register(cancelSubject, reqCancel)()
+	as.ErrorIs(reqCtx.Err(), context.Canceled)
+
+	// and forgotten once they expire
+	mux.lock.Lock()
+	mux.expire(time.Now().Add(earlyCancelTTL * 2))
+	mux.lock.Unlock()
+	as.Empty(mux.early)
+	as.Empty(mux.earlyQueue)
+}
@@ -0,0 +1,100 @@
+package natshttp
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	ErrChunkSequence = errors.ConstError("natshttp: chunk out of sequence")
+	ErrChunkChecksum = errors.ConstError("natshttp: chunk checksum mismatch")
+	ErrChunkAborted  = errors.ConstError("natshttp: chunk stream aborted by sender")
+
+	// maxAbortReasonLength limits the size of the abort header
+	maxAbortReasonLength = 512
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumPlaceholder has the same length as an encoded checksum, allowing the size of a chunk to be determined
+// before its data is known.
+const checksumPlaceholder = "00000000"
+
+// reserveChunkHeaders adds the sequence number and, if enabled, a placeholder for the checksum of a chunk. It must be
+// called before sizing the data field of msg, with sealChunk called once the data has been set.
+func reserveChunkHeaders(msg *nats.Msg, seq int, checksum bool) {
+	if msg.Header == nil {
+		msg.Header = make(nats.Header)
+	}
+	msg.Header.Set(HeaderChunkSeq, strconv.Itoa(seq))
+	if checksum {
+		msg.Header.Set(HeaderChunkChecksum, checksumPlaceholder)
+	}
+}
+
+// sealChunk computes the checksum of msg.Data if one was reserved.
+func sealChunk(msg *nats.Msg) {
+	if msg.Header.Get(HeaderChunkChecksum) != "" {
+		msg.Header.Set(HeaderChunkChecksum, chunkChecksum(msg.Data))
+	}
+}
+
+func chunkChecksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(data, crc32c))
+}
+
+// verifyChunk checks the sequence number and checksum of msg, if present. Peers which do not add these headers are
+// not verified.
+func verifyChunk(msg *nats.Msg, expectedSeq int) error {
+	h := msg.Header
+
+	if value := h.Get(HeaderChunkSeq); value != "" {
+		seq, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s header '%s'", ErrChunkSequence, HeaderChunkSeq, value)
+		}
+		if seq < expectedSeq {
+			return fmt.Errorf("%w: duplicate chunk %d, expected chunk %d", ErrChunkSequence, seq, expectedSeq)
+		}
+		if seq > expectedSeq {
+			return fmt.Errorf("%w: missing chunks %d to %d", ErrChunkSequence, expectedSeq, seq-1)
+		}
+	}
+
+	if expected := h.Get(HeaderChunkChecksum); expected != "" {
+		if actual := chunkChecksum(msg.Data); actual != expected {
+			return fmt.Errorf("%w: chunk %d has checksum %s, expected %s", ErrChunkChecksum, expectedSeq, actual, expected)
+		}
+	}
+
+	return nil
+}
+
+// newAbortMsg creates a control msg informing the receiver that the chunk stream has failed and will not complete.
+func newAbortMsg(subject string, reason error) *nats.Msg {
+	value := "unknown"
+	if reason != nil {
+		// header values cannot span multiple lines
+		value = strings.Join(strings.Fields(reason.Error()), " ")
+	}
+	if len(value) > maxAbortReasonLength {
+		value = value[:maxAbortReasonLength]
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(HeaderChunkAbort, value)
+	return msg
+}
+
+// abortError returns an error if msg is an abort control msg.
+func abortError(msg *nats.Msg) error {
+	if reason := msg.Header.Get(HeaderChunkAbort); reason != "" {
+		return fmt.Errorf("%w: %s", ErrChunkAborted, reason)
+	}
+	return nil
+}
@@ -4,25 +4,53 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 
 	"github.com/nats-io/nats.go"
 )
 
 type ChunkReader struct {
 	ctx context.Context
-	sub *nats.Subscription
+	sub Subscription
 
 	firstMsg      *nats.Msg
 	remainingMsgs <-chan *nats.Msg
 
-	idx    int
-	reader io.Reader
+	idx       int
+	reader    io.Reader
+	err       error
+	aborted   bool
+	abandoned bool
+
+	// trailer is populated from the final msg of the stream
+	trailer http.Header
+
+	// invoked once the end of the stream has been reached
+	onEOF func()
+
+	// limits the number of bytes which can be read after decompression, with zero indicating no limit
+	limit         int64
+	bytesRead     int64
+	limitExceeded bool
+
+	// the encodings the sender may compress the data of the chunks with, the one it announced and the decoder for it
+	decompress []string
+	encoding   string
+	decoder    io.ReadCloser
+
+	// flow control
+	conn       *nats.Conn
+	ackSubject string
+	ackEvery   int
+	consumed   int
+	eof        bool
 }
 
 func NewChunkReader(
 	firstMsg *nats.Msg,
-	sub *nats.Subscription,
+	sub Subscription,
 	ctx context.Context,
 ) (*ChunkReader, error) {
 	if sub == nil {
@@ -45,8 +73,80 @@ func NewChunkReader(
 	}, nil
 }
 
+// enableFlowControl causes the reader to acknowledge the chunks it consumes to the subject announced by the sender,
+// granting the sender credit for sending more.
+func (c *ChunkReader) enableFlowControl(conn *nats.Conn, window int) {
+	c.conn = conn
+	c.ackSubject = c.firstMsg.Header.Get(HeaderChunkAckSubject)
+	c.ackEvery = ackInterval(window)
+}
+
+// enableDecompression allows the sender to compress the data of the chunks with any of the given encodings, which
+// must have been negotiated with it beforehand. Otherwise the data is returned as sent.
+func (c *ChunkReader) enableDecompression(encodings []string) {
+	c.decompress = encodings
+}
+
 func (c *ChunkReader) Read(p []byte) (n int, err error) {
-	if c.reader == nil {
+	if c.limitExceeded {
+		return 0, c.err
+	}
+
+	n, err = c.decode(p)
+	if c.limit == 0 {
+		return n, err
+	}
+
+	// the limit applies to the data the caller reads, as a compressed stream can expand far beyond the data sent. The
+	// sender is told to stop as soon as it is crossed, rather than after it has sent everything
+	c.bytesRead += int64(n)
+	if c.bytesRead > c.limit {
+		n -= int(c.bytesRead - c.limit)
+		c.err = &http.MaxBytesError{Limit: c.limit}
+		c.limitExceeded = true
+		c.abandon()
+		return n, c.err
+	}
+
+	return n, err
+}
+
+// decode returns the data of the chunks, decompressing it once the sender announces compression.
+func (c *ChunkReader) decode(p []byte) (n int, err error) {
+	if c.decoder != nil {
+		return c.decoder.Read(p)
+	}
+
+	n, err = c.read(p)
+	if n > 0 || err != nil || c.encoding == "" {
+		return n, err
+	}
+
+	// the remainder of the stream is compressed, the decoder is only created now as it reads from the stream
+	// immediately
+	if c.decoder, err = newDecompressor(c.encoding, readerFunc(c.read)); err != nil {
+		c.err = err
+		return 0, err
+	}
+
+	return c.decoder.Read(p)
+}
+
+// read returns the data of the chunks as sent.
+func (c *ChunkReader) read(p []byte) (n int, err error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+
+	// errors are sticky as the stream cannot be recovered
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	// set once the sender announces that the data which follows is compressed
+	compressed := false
+
+	for c.reader == nil {
 
 		// determine next msg
 		var msg *nats.Msg
@@ -57,10 +157,48 @@ func (c *ChunkReader) Read(p []byte) (n int, err error) {
 			if err != nil {
 				return
 			}
+			if err = c.ack(); err != nil {
+				return
+			}
+		}
+
+		// the sender has failed and the stream will not complete
+		if c.err = abortError(msg); c.err != nil {
+			c.aborted = true
+			return 0, c.err
+		}
+
+		// ensure we haven't missed any chunks and the chunk is intact
+		if c.err = verifyChunk(msg, c.consumed); c.err != nil {
+			return 0, c.err
+		}
+
+		// the compression of the stream is announced by the first chunk it applies to
+		if encoding := msg.Header.Get(HeaderCompression); encoding != "" && c.decompress != nil && c.encoding == "" {
+			if !containsString(c.decompress, encoding) {
+				c.err = fmt.Errorf("%w '%s'", ErrUnsupportedCompression, encoding)
+				return 0, c.err
+			}
+			c.encoding = encoding
+			compressed = true
+		}
+
+		// the first msg of a chunk stream may carry only headers, for example when the sender waits for permission to
+		// send the body, whereas a single msg response without data has no sequence number
+		if len(msg.Data) == 0 && c.idx == 0 && msg.Header.Get(HeaderChunkSeq) != "" {
+			c.idx += 1
+			continue
 		}
 
 		// empty data indicates the end of the chunk stream
 		if len(msg.Data) == 0 {
+			if c.trailer != nil && c.idx > 0 {
+				readTrailerHeaders(msg, c.trailer)
+			}
+			c.eof = true
+			if c.onEOF != nil {
+				c.onEOF()
+			}
 			return 0, io.EOF
 		}
 
@@ -69,6 +207,11 @@ func (c *ChunkReader) Read(p []byte) (n int, err error) {
 		c.idx += 1
 	}
 
+	// the data which follows must be read through a decoder
+	if compressed {
+		return 0, nil
+	}
+
 	// read from the current chunk
 	n, err = c.reader.Read(p)
 
@@ -82,6 +225,28 @@ func (c *ChunkReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// ack records the consumption of a chunk, periodically acknowledging it to the sender.
+func (c *ChunkReader) ack() error {
+	c.consumed += 1
+	if c.ackSubject == "" || c.ackEvery == 0 || c.consumed%c.ackEvery != 0 {
+		return nil
+	}
+	return c.conn.PublishMsg(newAckMsg(c.ackSubject, c.consumed))
+}
+
 func (c *ChunkReader) Close() error {
+	if c.decoder != nil {
+		_ = c.decoder.Close()
+	}
+
+	c.abandon()
 	return c.sub.Unsubscribe()
 }
+
+// abandon lets the sender know we will not be consuming the remainder of the stream.
+func (c *ChunkReader) abandon() {
+	if !c.eof && !c.aborted && !c.abandoned && c.ackSubject != "" {
+		_ = c.conn.PublishMsg(newClosedMsg(c.ackSubject, c.consumed))
+	}
+	c.abandoned = true
+}
@@ -0,0 +1,228 @@
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newChunk(seq int, data string, checksum bool) *nats.Msg {
+	msg := nats.NewMsg("")
+	reserveChunkHeaders(msg, seq, checksum)
+	msg.Data = []byte(data)
+	sealChunk(msg)
+	return msg
+}
+
+func TestVerifyChunk(t *testing.T) {
+	assert.Nil(t, verifyChunk(newChunk(1, "hello", false), 1))
+	assert.Nil(t, verifyChunk(newChunk(1, "hello", true), 1))
+
+	// peers which don't add sequence numbers are not verified
+	assert.Nil(t, verifyChunk(nats.NewMsg(""), 5))
+
+	err := verifyChunk(newChunk(1, "hello", false), 2)
+	assert.ErrorIs(t, err, ErrChunkSequence)
+	assert.Contains(t, err.Error(), "duplicate chunk 1")
+
+	err = verifyChunk(newChunk(4, "hello", false), 2)
+	assert.ErrorIs(t, err, ErrChunkSequence)
+	assert.Contains(t, err.Error(), "missing chunks 2 to 3")
+
+	corrupted := newChunk(1, "hello", true)
+	corrupted.Data[0] = 'j'
+	assert.ErrorIs(t, verifyChunk(corrupted, 1), ErrChunkChecksum)
+}
+
+func TestChunkReader_Integrity(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	newReader := func(t *testing.T, chunks ...*nats.Msg) *ChunkReader {
+		inbox := conn.NewInbox()
+		sub, err := conn.SubscribeSync(inbox)
+		assert.Nil(t, err)
+
+		for _, chunk := range chunks {
+			chunk.Subject = inbox
+			assert.Nil(t, conn.PublishMsg(chunk))
+		}
+
+		reader, err := NewChunkReader(newChunk(0, "a", true), sub, ctx)
+		assert.Nil(t, err)
+		return reader
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		reader := newReader(t, newChunk(1, "b", true), newChunk(2, "c", true), newChunk(3, "", false))
+		b, err := io.ReadAll(reader)
+		assert.Nil(t, err)
+		assert.Equal(t, "abc", string(b))
+		assert.Nil(t, reader.Close())
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		reader := newReader(t, newChunk(1, "b", true), newChunk(3, "d", true), newChunk(4, "", false))
+		_, err := io.ReadAll(reader)
+		assert.ErrorIs(t, err, ErrChunkSequence)
+
+		// errors are sticky
+		_, err = reader.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, ErrChunkSequence)
+		assert.Nil(t, reader.Close())
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		reader := newReader(t, newChunk(1, "b", true), newChunk(1, "b", true), newChunk(2, "", false))
+		_, err := io.ReadAll(reader)
+		assert.ErrorIs(t, err, ErrChunkSequence)
+		assert.Nil(t, reader.Close())
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		chunk := newChunk(1, "b", true)
+		chunk.Data = []byte("x")
+
+		reader := newReader(t, chunk, newChunk(2, "", false))
+		_, err := io.ReadAll(reader)
+		assert.ErrorIs(t, err, ErrChunkChecksum)
+		assert.Nil(t, reader.Close())
+	})
+}
+
+func TestChunkChecksums(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Put("/echo", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		_, err := io.Copy(w, r.Body)
+		assert.Nil(t, err)
+	})
+
+	srv := Server{
+		Conn:           conn,
+		Subject:        subject,
+		Handler:        routes,
+		ChunkChecksums: true,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+	waitForResponders(t, conn)
+
+	body := make([]byte, conn.MaxPayload()*5)
+	_, err := rand.Read(body)
+	assert.Nil(t, err)
+
+	req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/echo", bytes.NewReader(body))
+	assert.Nil(t, err)
+
+	resp, err := (&Transport{Conn: conn, ChunkChecksums: true}).RoundTrip(req)
+	assert.Nil(t, err)
+
+	// the chunk stream is verified by the transport, its headers are not exposed with the response
+	for _, key := range []string{HeaderChunkSeq, HeaderChunkChecksum, HeaderChunkAckSubject, HeaderChunkWindow} {
+		assert.Empty(t, resp.Header.Get(key), key)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, body, b)
+	assert.Nil(t, resp.Body.Close())
+}
+
+type failingReader struct {
+	io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (n int, err error) {
+	n, err = f.Reader.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return
+}
+
+func TestChunkStream_Abort(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	body := make([]byte, conn.MaxPayload()*3)
+	_, err := rand.Read(body)
+	assert.Nil(t, err)
+
+	handlerErr := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		handlerErr <- err
+	})
+	routes.Get("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		_, err := w.Write(body)
+		assert.Nil(t, err)
+		assert.Nil(t, w.(*ResponseWriter).Abort(errors.New("database\nwent away")))
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	transport := &Transport{Conn: conn}
+
+	t.Run("request", func(t *testing.T) {
+		reqBody := &failingReader{Reader: bytes.NewReader(body), err: errors.New("disk on fire")}
+
+		req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload", reqBody)
+		assert.Nil(t, err)
+		req.TransferEncoding = []string{"chunked"}
+
+		_, err = transport.RoundTrip(req)
+		assert.EqualError(t, err, "disk on fire")
+
+		select {
+		case err = <-handlerErr:
+			assert.ErrorIs(t, err, ErrChunkAborted)
+			assert.Contains(t, err.Error(), "disk on fire")
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler was not informed of the abort")
+		}
+	})
+
+	t.Run("response", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/download", nil)
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+
+		_, err = io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, ErrChunkAborted)
+		assert.Contains(t, err.Error(), "went away")
+		assert.Nil(t, resp.Body.Close())
+	})
+}
@@ -0,0 +1,170 @@
+package natshttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	ErrUnsupportedCompression = errors.ConstError("natshttp: unsupported compression")
+
+	// minCompressionSize is the content length below which a body is not worth compressing
+	minCompressionSize = 1024
+
+	// maxCompressionWindow bounds the zstd window, and with it the memory a decoder allocates. The frame header is
+	// under the control of the sender, which could otherwise declare a window of hundreds of megabytes.
+	maxCompressionWindow = 1 << 20
+)
+
+// SupportedCompression lists the wire compressions which can be negotiated, in order of preference.
+var SupportedCompression = []string{CompressionZstd, CompressionGzip}
+
+func validateCompression(encodings []string) error {
+	for _, encoding := range encodings {
+		if !isSupportedCompression(encoding) {
+			return fmt.Errorf("%w '%s'", ErrUnsupportedCompression, encoding)
+		}
+	}
+	return nil
+}
+
+func isSupportedCompression(encoding string) bool {
+	return containsString(SupportedCompression, encoding)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateCompression selects the first of the preferred encodings which has been accepted by the receiver, where
+// accepted is the value of an X-Accept-Compression header. An empty string indicates no compression.
+func negotiateCompression(accepted string, preferred []string) string {
+	if accepted == "" {
+		return ""
+	}
+	for _, encoding := range preferred {
+		for _, value := range strings.Split(accepted, ",") {
+			if strings.TrimSpace(value) == encoding {
+				return encoding
+			}
+		}
+	}
+	return ""
+}
+
+// compressor is implemented by the supported encoders, allowing partially written data to be flushed.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func newCompressor(encoding string, w io.Writer) (compressor, error) {
+	switch encoding {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		// chunks are compressed as they are written, so there is nothing to gain from concurrency
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(maxCompressionWindow))
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnsupportedCompression, encoding)
+	}
+}
+
+func newDecompressor(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case CompressionGzip:
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	case CompressionZstd:
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(maxCompressionWindow),
+			zstd.WithDecoderMaxMemory(maxCompressionWindow),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnsupportedCompression, encoding)
+	}
+}
+
+// compressingReader compresses the data read from src. Data is flushed from the encoder whenever src has nothing
+// more to return immediately, so that streamed bodies are not held up waiting for more data.
+type compressingReader struct {
+	src     io.Reader
+	buf     *bytes.Buffer
+	encoder compressor
+	scratch []byte
+	err     error
+}
+
+func newCompressingReader(encoding string, src io.Reader) (*compressingReader, error) {
+	buf := bytes.NewBuffer(nil)
+	encoder, err := newCompressor(encoding, buf)
+	if err != nil {
+		return nil, err
+	}
+	return &compressingReader{
+		src:     src,
+		buf:     buf,
+		encoder: encoder,
+		scratch: make([]byte, 32*1024),
+	}, nil
+}
+
+func (c *compressingReader) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		n, err := c.src.Read(c.scratch)
+		if n > 0 {
+			if _, werr := c.encoder.Write(c.scratch[:n]); werr != nil {
+				c.err = werr
+				continue
+			}
+		}
+
+		switch {
+		case err == io.EOF:
+			c.err = io.EOF
+			if cerr := c.encoder.Close(); cerr != nil {
+				c.err = cerr
+			}
+		case err != nil:
+			c.err = err
+		case n < len(c.scratch):
+			if ferr := c.encoder.Flush(); ferr != nil {
+				c.err = ferr
+			}
+		}
+	}
+
+	return c.buf.Read(p)
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
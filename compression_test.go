@@ -0,0 +1,315 @@
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	as := assert.New(t)
+
+	as.Equal("", negotiateCompression("", SupportedCompression))
+	as.Equal("", negotiateCompression("zstd, gzip", nil))
+	as.Equal("", negotiateCompression("br", SupportedCompression))
+	as.Equal("zstd", negotiateCompression("gzip, zstd", []string{"zstd", "gzip"}))
+	as.Equal("gzip", negotiateCompression("gzip,zstd", []string{"gzip", "zstd"}))
+	as.Equal("gzip", negotiateCompression("br, gzip", SupportedCompression))
+
+	as.Nil(validateCompression(SupportedCompression))
+	as.ErrorIs(validateCompression([]string{"br"}), ErrUnsupportedCompression)
+}
+
+func TestDecompressor_HostileWindow(t *testing.T) {
+	as := assert.New(t)
+
+	// a frame declaring a 512MB window, followed by a single raw block of 10 bytes
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x98, 0x51, 0x00, 0x00}
+	frame = append(frame, []byte("0123456789")...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	d, err := newDecompressor(CompressionZstd, bytes.NewReader(frame))
+	as.Nil(err)
+	_, err = io.ReadAll(d)
+	as.ErrorIs(err, zstd.ErrWindowSizeExceeded)
+	_ = d.Close()
+
+	runtime.ReadMemStats(&after)
+	as.Less(after.TotalAlloc-before.TotalAlloc, uint64(64<<20))
+}
+
+func TestCompression(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+
+	clientConn := client(t, s)
+
+	// highly compressible
+	body := bytes.Repeat([]byte(`{"hello":"world","foo":"bar"},`), int(clientConn.MaxPayload())/10)
+
+	routes := chi.NewRouter()
+	routes.Get("/body/{size}", func(w http.ResponseWriter, r *http.Request) {
+		size, err := strconv.Atoi(chi.URLParam(r, "size"))
+		assert.Nil(t, err)
+
+		w.Header().Set("Trailer", "X-Size")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body[:size])
+		w.Header().Set("X-Size", strconv.Itoa(size))
+	})
+	routes.Get("/small", func(w http.ResponseWriter, r *http.Request) {
+		// sent as a single msg with a content length
+		_, _ = w.Write(body[:SmallBodySize])
+	})
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, b)
+		w.Header().Set("X-Checksum", r.Trailer.Get("X-Checksum"))
+	})
+	routes.Get("/encoded", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "br")
+		_, _ = w.Write(body)
+	})
+
+	for _, encoding := range SupportedCompression {
+		encoding := encoding
+
+		t.Run(encoding, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// closing the connection removes the subscription before the next server starts
+			serverConn := client(t, s)
+			defer serverConn.Close()
+
+			srv := Server{
+				Conn:        serverConn,
+				Subject:     subject,
+				Handler:     routes,
+				Compression: []string{encoding},
+			}
+
+			go func() {
+				_ = srv.Listen(ctx)
+			}()
+
+			waitForResponders(t, clientConn)
+
+			for _, size := range []int{16, 64 * 1024, len(body)} {
+				t.Run(strconv.Itoa(size), func(t *testing.T) {
+					as := assert.New(t)
+
+					for _, disabled := range []bool{false, true} {
+						transport := &Transport{Conn: clientConn, DisableCompression: disabled}
+						inBytes := clientConn.Stats().InBytes
+
+						req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("nats+http://%s/body/%d", subject, size), nil)
+						as.Nil(err)
+
+						resp, err := transport.RoundTrip(req)
+						as.Nil(err)
+						as.Equal(http.StatusOK, resp.StatusCode)
+						as.Empty(resp.Header.Get(HeaderCompression))
+
+						b, err := io.ReadAll(resp.Body)
+						as.Nil(err)
+						as.Nil(resp.Body.Close())
+						as.Equal(body[:size], b)
+						as.Equal(strconv.Itoa(size), resp.Trailer.Get("X-Size"))
+
+						received := clientConn.Stats().InBytes - inBytes
+						if disabled || size < minCompressionSize {
+							as.Greater(received, uint64(size))
+						} else {
+							as.Less(received, uint64(size/4))
+						}
+					}
+				})
+			}
+
+			t.Run("single msg", func(t *testing.T) {
+				as := assert.New(t)
+
+				inBytes := clientConn.Stats().InBytes
+
+				req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("nats+http://%s/small", subject), nil)
+				as.Nil(err)
+
+				resp, err := (&Transport{Conn: clientConn}).RoundTrip(req)
+				as.Nil(err)
+				as.Equal(int64(SmallBodySize), resp.ContentLength)
+
+				b, err := io.ReadAll(resp.Body)
+				as.Nil(err)
+				as.Nil(resp.Body.Close())
+				as.Equal(body[:SmallBodySize], b)
+
+				as.Less(clientConn.Stats().InBytes-inBytes, uint64(SmallBodySize/2))
+			})
+
+			t.Run("request", func(t *testing.T) {
+				as := assert.New(t)
+
+				for _, disabled := range []bool{false, true} {
+					transport := &Transport{Conn: clientConn, DisableCompression: disabled}
+					outBytes := clientConn.Stats().OutBytes
+
+					req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("nats+http://%s/upload", subject), bytes.NewReader(body))
+					as.Nil(err)
+					req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+
+					resp, err := transport.RoundTrip(req)
+					as.Nil(err)
+					as.Equal(http.StatusOK, resp.StatusCode)
+					as.Equal("abc", resp.Header.Get("X-Checksum"))
+					as.Nil(resp.Body.Close())
+
+					// the server accepts the compression during the chunk handshake, so only the first chunk is
+					// sent uncompressed
+					sent := clientConn.Stats().OutBytes - outBytes
+					if disabled {
+						as.Greater(sent, uint64(len(body)))
+					} else {
+						as.Less(sent, uint64(len(body)/2))
+					}
+				}
+			})
+
+			t.Run("encoded", func(t *testing.T) {
+				as := assert.New(t)
+
+				inBytes := clientConn.Stats().InBytes
+
+				req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("nats+http://%s/encoded", subject), nil)
+				as.Nil(err)
+
+				resp, err := (&Transport{Conn: clientConn}).RoundTrip(req)
+				as.Nil(err)
+
+				b, err := io.ReadAll(resp.Body)
+				as.Nil(err)
+				as.Nil(resp.Body.Close())
+				as.Equal(body, b)
+
+				// bodies which already have a content encoding are not compressed again
+				as.Greater(clientConn.Stats().InBytes-inBytes, uint64(len(body)))
+			})
+		})
+	}
+}
+
+func TestCompression_NotNegotiated(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	body := bytes.Repeat([]byte("hello world"), int(conn.MaxPayload())/4)
+
+	routes := chi.NewRouter()
+	routes.Put("/echo", func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(w, r.Body)
+		assert.Nil(t, err)
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	// the server has not agreed to decompress request bodies, so the header is not acted upon
+	req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/echo", bytes.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set(HeaderCompression, CompressionGzip)
+
+	resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Body.Close())
+	assert.Equal(t, body, b)
+}
+
+func TestCompression_RequestLimit(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	limit := conn.MaxPayload() * 4
+	readErrs := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		readErrs <- err
+		if err == nil {
+			_, _ = io.WriteString(w, strconv.Itoa(len(b)))
+		}
+	})
+
+	srv := &Server{
+		Conn:                conn,
+		Subject:             subject,
+		Handler:             routes,
+		Compression:         []string{CompressionGzip},
+		MaxRequestBodyBytes: limit,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	for _, size := range []int64{limit, limit * 16} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			as := assert.New(t)
+
+			outBytes := conn.Stats().OutBytes
+
+			// compresses to well within the limit
+			req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload", bytes.NewReader(make([]byte, size)))
+			as.Nil(err)
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+
+			resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+			as.Nil(err)
+
+			b, err := io.ReadAll(resp.Body)
+			as.Nil(err)
+			as.Nil(resp.Body.Close())
+
+			as.Less(conn.Stats().OutBytes-outBytes, uint64(limit))
+
+			if size <= limit {
+				as.Equal(http.StatusOK, resp.StatusCode)
+				as.Equal(strconv.FormatInt(size, 10), string(b))
+				as.Nil(<-readErrs)
+				return
+			}
+
+			as.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+			var maxBytesErr *http.MaxBytesError
+			as.ErrorAs(<-readErrs, &maxBytesErr)
+			as.Equal(limit, maxBytesErr.Limit)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package natshttp
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// headers used by the Transport to describe its connection to the server
+	HeaderClientID   = "X-Nats-Client-Id"
+	HeaderClientName = "X-Nats-Client-Name"
+	HeaderClientIP   = "X-Nats-Client-Ip"
+)
+
+type contextKey struct {
+	name string
+}
+
+var (
+	serverContextKey     = &contextKey{"server"}
+	msgContextKey        = &contextKey{"msg"}
+	clientInfoContextKey = &contextKey{"client-info"}
+)
+
+// ClientInfo describes the NATS connection of the client which sent a request, as announced by the client itself.
+// Any NATS publisher can forge these values, so they must not be relied upon for authentication or access control.
+type ClientInfo struct {
+	// ID assigned to the client by the NATS server it is connected to.
+	ID uint64
+	// Name the client provided when connecting, if any.
+	Name string
+	// IP of the client as seen by the NATS server it is connected to.
+	IP net.IP
+}
+
+// ServerFromContext returns the Server which is handling a request.
+func ServerFromContext(ctx context.Context) (*Server, bool) {
+	s, ok := ctx.Value(serverContextKey).(*Server)
+	return s, ok
+}
+
+// MsgFromContext returns the msg a request was received in, providing access to the original subject, reply inbox
+// and headers. For chunked requests this is the first msg of the chunk stream.
+func MsgFromContext(ctx context.Context) (*nats.Msg, bool) {
+	msg, ok := ctx.Value(msgContextKey).(*nats.Msg)
+	return msg, ok
+}
+
+// ClientInfoFromContext returns information about the NATS connection of the client which sent a request. It is only
+// available if the client announced it, as the Transport does, and is asserted by the client rather than verified.
+func ClientInfoFromContext(ctx context.Context) (*ClientInfo, bool) {
+	info, ok := ctx.Value(clientInfoContextKey).(*ClientInfo)
+	return info, ok
+}
+
+// setClientInfoHeaders announces the connection details of the client, allowing the server to identify it.
+func setClientInfoHeaders(conn *nats.Conn, h nats.Header) {
+	if id, err := conn.GetClientID(); err == nil {
+		h.Set(HeaderClientID, strconv.FormatUint(id, 10))
+	}
+	if name := conn.Opts.Name; name != "" {
+		h.Set(HeaderClientName, name)
+	}
+	if ip, err := conn.GetClientIP(); err == nil {
+		h.Set(HeaderClientIP, ip.String())
+	}
+}
+
+// clientInfo reads the connection details announced by the client, returning nil if there are none. As the details
+// are informational, invalid values are ignored.
+func clientInfo(h nats.Header) *ClientInfo {
+	if h.Get(HeaderClientID) == "" && h.Get(HeaderClientName) == "" && h.Get(HeaderClientIP) == "" {
+		return nil
+	}
+
+	info := &ClientInfo{
+		Name: h.Get(HeaderClientName),
+		IP:   net.ParseIP(h.Get(HeaderClientIP)),
+	}
+
+	if id, err := strconv.ParseUint(h.Get(HeaderClientID), 10, 64); err == nil {
+		info.ID = id
+	}
+
+	return info
+}
+
+// requestValues attaches the msg and the server handling it to ctx.
+func (s *Server) requestValues(ctx context.Context, msg *nats.Msg) context.Context {
+	ctx = context.WithValue(ctx, serverContextKey, s)
+	ctx = context.WithValue(ctx, msgContextKey, msg)
+	if info := clientInfo(msg.Header); info != nil {
+		ctx = context.WithValue(ctx, clientInfoContextKey, info)
+	}
+	return ctx
+}
@@ -0,0 +1,140 @@
+package natshttp
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestContext(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s, nats.Name("context-test"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requests := make(chan *http.Request, 1)
+
+	routes := chi.NewRouter()
+	routes.Get("/foo/bar", func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	})
+
+	srv := &Server{
+		Conn:            conn,
+		Subject:         subject,
+		Handler:         routes,
+		TrustClientInfo: true,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	// client info is not trusted by default
+	untrusted := &Server{
+		Conn:    conn,
+		Subject: "untrusted",
+		Handler: routes,
+	}
+
+	go func() {
+		_ = untrusted.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	for i := 0; i < 100; i++ {
+		if _, err := conn.Request("untrusted.HEAD", nil, time.Second); err != nats.ErrNoResponders {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		as := assert.New(t)
+
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/foo/bar?baz=1", nil)
+		as.Nil(err)
+
+		resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+
+		r := <-requests
+
+		server, ok := ServerFromContext(r.Context())
+		as.True(ok)
+		as.Same(srv, server)
+
+		msg, ok := MsgFromContext(r.Context())
+		as.True(ok)
+		as.Equal(subject+".foo.bar.GET", msg.Subject)
+		as.NotEmpty(msg.Reply)
+		as.Equal("/foo/bar", msg.Header.Get(HeaderPath))
+
+		// protocol headers are only available from the msg
+		as.Empty(r.Header.Get(HeaderPath))
+		as.Empty(r.Header.Get(HeaderClientID))
+		as.NotEmpty(msg.Header.Get(HeaderClientID))
+
+		id, err := conn.GetClientID()
+		as.Nil(err)
+		ip, err := conn.GetClientIP()
+		as.Nil(err)
+
+		info, ok := ClientInfoFromContext(r.Context())
+		as.True(ok)
+		as.Equal(id, info.ID)
+		as.Equal("context-test", info.Name)
+		as.True(ip.Equal(info.IP))
+
+		as.Equal(ip.String()+":0", r.RemoteAddr)
+		as.Equal("/foo/bar?baz=1", r.RequestURI)
+		as.Equal(subject, r.Host)
+		as.True(r.ProtoAtLeast(1, 1))
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		as := assert.New(t)
+
+		req, err := http.NewRequest(http.MethodGet, "nats+http://untrusted/foo/bar", nil)
+		as.Nil(err)
+
+		resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+
+		r := <-requests
+
+		// the client info is still available, but it is not mistaken for the address of the peer
+		_, ok := ClientInfoFromContext(r.Context())
+		as.True(ok)
+		as.Empty(r.RemoteAddr)
+	})
+
+	t.Run("without client info", func(t *testing.T) {
+		as := assert.New(t)
+
+		msg := nats.NewMsg(subject + ".foo.bar.GET")
+		msg.Header.Set(HeaderPath, "/foo/bar")
+
+		_, err := conn.RequestMsg(msg, time.Second)
+		as.Nil(err)
+
+		r := <-requests
+
+		_, ok := MsgFromContext(r.Context())
+		as.True(ok)
+
+		_, ok = ClientInfoFromContext(r.Context())
+		as.False(ok)
+		as.Empty(r.RemoteAddr)
+	})
+}
@@ -0,0 +1,73 @@
+package natshttp
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	headerExpect   = "Expect"
+	expectContinue = "100-continue"
+
+	ErrBodyAfterResponse = errors.ConstError("natshttp: request body cannot be read after the response has started")
+)
+
+// expectsContinue returns true if the sender of h will wait for permission before sending the request body.
+func expectsContinue(h http.Header) bool {
+	return strings.EqualFold(h.Get(headerExpect), expectContinue)
+}
+
+// setContinueHeaders marks a chunk handshake as granting permission to send the request body.
+func setContinueHeaders(msg *nats.Msg) {
+	msg.Header.Set(HeaderStatus, http.StatusText(http.StatusContinue))
+	msg.Header.Set(HeaderStatusCode, strconv.Itoa(http.StatusContinue))
+}
+
+// isFinalResponse returns true if msg, received in place of a chunk handshake, is a response from the server which
+// has declined to receive the request body.
+func isFinalResponse(msg *nats.Msg) bool {
+	code := msg.Header.Get(HeaderStatusCode)
+	return msg.Reply == "" && code != "" && code != strconv.Itoa(http.StatusContinue)
+}
+
+// continueReader defers the chunk handshake until the request body is first read, giving the handler the opportunity
+// to respond before the client sends the body.
+type continueReader struct {
+	// handshake sends the chunk handshake and returns a reader for the body
+	handshake func() (io.ReadCloser, error)
+	// responded returns true once the response has been sent, after which the body can no longer be requested
+	responded func() bool
+
+	reader io.ReadCloser
+	err    error
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if c.reader == nil && c.err == nil {
+		if c.responded != nil && c.responded() {
+			c.err = ErrBodyAfterResponse
+		} else {
+			c.reader, c.err = c.handshake()
+		}
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+func (c *continueReader) Close() error {
+	if c.reader == nil {
+		// the body was never requested, so the client has not sent it
+		c.err = http.ErrBodyReadAfterClose
+		return nil
+	}
+	return c.reader.Close()
+}
@@ -0,0 +1,169 @@
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectContinue(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	maxUpload := int64(conn.MaxPayload()) * 4
+
+	var handled atomic.Int32
+
+	routes := chi.NewRouter()
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		handled.Add(1)
+
+		// reject large uploads before the client has sent them
+		if r.ContentLength > maxUpload {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		n, err := io.Copy(io.Discard, r.Body)
+		assert.Nil(t, err)
+
+		_, _ = io.WriteString(w, strconv.FormatInt(n, 10))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	runProxy(t, routes, listener, conn, "", ctx)
+
+	newRequest := func(t *testing.T, url string, size int64, expect string) (*http.Request, *countingReader) {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		assert.Nil(t, err)
+
+		body := &countingReader{Reader: bytes.NewReader(data)}
+
+		req, err := http.NewRequest(http.MethodPut, url, body)
+		assert.Nil(t, err)
+		req.ContentLength = size
+		req.Header.Set("Expect", expect)
+
+		return req, body
+	}
+
+	transport := &Transport{Conn: conn}
+	natsUrl := "nats+http://" + subject + "/upload"
+
+	t.Run("accepted", func(t *testing.T) {
+		size := int64(conn.MaxPayload()) * 3
+
+		req, body := newRequest(t, natsUrl, size, "100-continue")
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, resp.Body.Close())
+
+		assert.Equal(t, strconv.FormatInt(size, 10), string(b))
+		assert.Equal(t, size, body.count.Load())
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		req, body := newRequest(t, natsUrl, maxUpload+1, "100-continue")
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+
+		// the body should never have been read
+		assert.Equal(t, int64(0), body.count.Load())
+	})
+
+	t.Run("unsupported expectation", func(t *testing.T) {
+		before := handled.Load()
+
+		req, body := newRequest(t, natsUrl, 16, "something-else")
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusExpectationFailed, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+
+		// the handler should not have been invoked
+		assert.Equal(t, before, handled.Load())
+		assert.Equal(t, int64(16), body.count.Load())
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second},
+		}
+		url := fmt.Sprintf("http://%s/upload", listener.Addr().String())
+
+		size := int64(conn.MaxPayload()) * 3
+		req, body := newRequest(t, url, size, "100-continue")
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+		assert.Equal(t, size, body.count.Load())
+
+		req, body = newRequest(t, url, maxUpload+1, "100-continue")
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+		assert.Equal(t, int64(0), body.count.Load())
+	})
+}
+
+func TestExpectContinue_ReadAfterResponse(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		// a response larger than a single msg is sent before the body is read
+		_, _ = w.Write(make([]byte, conn.MaxPayload()*2))
+
+		_, err := r.Body.Read(make([]byte, 16))
+		errs <- err
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload", bytes.NewReader(make([]byte, conn.MaxPayload()*2)))
+	assert.Nil(t, err)
+	req.Header.Set("Expect", "100-continue")
+
+	resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Body.Close())
+
+	assert.ErrorIs(t, <-errs, ErrBodyAfterResponse)
+}
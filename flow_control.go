@@ -0,0 +1,152 @@
+package natshttp
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// DefaultChunkWindow is the default number of chunks which can be in-flight without being acknowledged.
+	DefaultChunkWindow = 16
+
+	ErrReceiverClosed = errors.ConstError("natshttp: receiver is no longer consuming the chunk stream")
+)
+
+// chunkWindow applies the default to a configured window size. A negative value disables flow control.
+func chunkWindow(window int) int {
+	switch {
+	case window == 0:
+		return DefaultChunkWindow
+	case window < 0:
+		return 0
+	default:
+		return window
+	}
+}
+
+// ackInterval determines how many chunks a receiver consumes between sending acknowledgements. Acknowledging
+// every half window allows the sender to keep publishing whilst the acknowledgement is in transit.
+func ackInterval(window int) int {
+	if window <= 0 {
+		return 0
+	}
+	if interval := window / 2; interval > 0 {
+		return interval
+	}
+	return 1
+}
+
+// sendWindow determines the window a sender must respect. The receiver acknowledges chunks at an interval derived
+// from the window it announced, so a sender cannot choose a smaller window without risking a deadlock. It can however
+// opt out of flow control by disabling it locally, where 0 indicates that flow control is disabled.
+func sendWindow(announced int, local int) int {
+	if local == 0 {
+		return 0
+	}
+	return announced
+}
+
+// parseChunkWindow reads the window announced by a receiver, returning 0 if none was announced.
+func parseChunkWindow(msg *nats.Msg) (int, error) {
+	value := msg.Header.Get(HeaderChunkWindow)
+	if value == "" {
+		return 0, nil
+	}
+	window, err := strconv.Atoi(value)
+	if err != nil || window < 0 {
+		return 0, errors.Errorf("natshttp: invalid %s header '%s'", HeaderChunkWindow, value)
+	}
+	return window, nil
+}
+
+// flowControl tracks the credit available to the sender of a chunk stream. Receivers grant credit by acknowledging
+// the number of chunks they have consumed, and the sender pauses when the window has been exhausted.
+type flowControl struct {
+	window int
+	sent   int
+	acked  int
+	acks   Subscription
+}
+
+func newFlowControl(window int, acks Subscription) *flowControl {
+	return &flowControl{
+		window: window,
+		acks:   acks,
+	}
+}
+
+// acquire blocks until there is credit available for sending another chunk. It returns ErrReceiverClosed if the
+// receiver has indicated it will not consume any more chunks.
+func (f *flowControl) acquire(ctx context.Context) error {
+	// without a window there is no waiting for credit, but the sender must still stop once the receiver has closed
+	if f.window == 0 {
+		if err := f.poll(); err != nil {
+			return err
+		}
+	}
+	for f.window > 0 && f.sent-f.acked >= f.window {
+		msg, err := f.acks.NextMsgWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		if err = f.process(msg); err != nil {
+			return err
+		}
+	}
+	f.sent += 1
+	return nil
+}
+
+// poll processes the acks which have already been received, without waiting for more.
+func (f *flowControl) poll() error {
+	inbox, ok := f.acks.(*respInbox)
+	if !ok {
+		return nil
+	}
+	for {
+		msg, err := inbox.nextPending()
+		if msg == nil || err != nil {
+			return err
+		}
+		if err = f.process(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *flowControl) process(msg *nats.Msg) error {
+	h := msg.Header
+
+	if h.Get(HeaderChunkClosed) != "" {
+		return ErrReceiverClosed
+	}
+
+	acked, err := strconv.Atoi(h.Get(HeaderChunkAck))
+	if err != nil {
+		return errors.Annotatef(err, "natshttp: invalid %s header '%s'", HeaderChunkAck, h.Get(HeaderChunkAck))
+	}
+
+	// acks may be re-ordered or duplicated, so we only ever move forward
+	if acked > f.acked {
+		f.acked = acked
+	}
+
+	return nil
+}
+
+// newAckMsg creates an acknowledgement for the given number of consumed chunks.
+func newAckMsg(subject string, consumed int) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(HeaderChunkAck, strconv.Itoa(consumed))
+	return msg
+}
+
+// newClosedMsg creates a msg informing the sender that the receiver will not consume any more chunks.
+func newClosedMsg(subject string, consumed int) *nats.Msg {
+	msg := newAckMsg(subject, consumed)
+	msg.Header.Set(HeaderChunkClosed, "true")
+	return msg
+}
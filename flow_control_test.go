@@ -0,0 +1,272 @@
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingReader struct {
+	io.Reader
+	count atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.Reader.Read(p)
+	c.count.Add(int64(n))
+	return
+}
+
+func TestFlowControl_RequestBody(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunkSize := int(conn.MaxPayload())
+
+	body := make([]byte, chunkSize*40)
+	_, err := rand.Read(body)
+	assert.Nil(t, err)
+
+	reader := &countingReader{Reader: bytes.NewReader(body)}
+
+	routes := chi.NewRouter()
+
+	routes.Put("/slow", func(w http.ResponseWriter, r *http.Request) {
+		// give the client time to send as much as it is allowed to
+		<-time.After(300 * time.Millisecond)
+
+		// the client should have been paused once the window was exhausted, allowing for the msgs buffered
+		// between reading the request body and publishing
+		assert.Less(t, reader.count.Load(), int64(chunkSize*16))
+
+		b, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, b)
+	})
+
+	routes.Put("/reject", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	})
+
+	srv := Server{
+		Conn:        conn,
+		Subject:     subject,
+		Handler:     routes,
+		ChunkWindow: 2,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+	waitForResponders(t, conn)
+
+	transport := &Transport{Conn: conn}
+
+	t.Run("slow", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/slow", reader)
+		assert.Nil(t, err)
+		req.ContentLength = int64(len(body))
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodPut, "nats+http://"+subject+"/reject", bytes.NewReader(body))
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+	})
+}
+
+func TestFlowControl_Acquire(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	mux, err := newInboxMux(conn, -1, -1)
+	assert.Nil(t, err)
+	defer func() { _ = mux.Close() }()
+
+	acks := mux.NewInbox()
+	fc := newFlowControl(2, acks)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.Nil(t, fc.acquire(ctx))
+	assert.Nil(t, fc.acquire(ctx))
+
+	// the window has been exhausted
+	shortCtx, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	assert.ErrorIs(t, fc.acquire(shortCtx), context.DeadlineExceeded)
+
+	assert.Nil(t, conn.PublishMsg(newAckMsg(acks.Subject, 1)))
+	assert.Nil(t, fc.acquire(ctx))
+
+	assert.Nil(t, conn.PublishMsg(newClosedMsg(acks.Subject, 1)))
+	assert.ErrorIs(t, fc.acquire(ctx), ErrReceiverClosed)
+}
+
+func TestFlowControl_ResponseBody(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chunkSize := int(conn.MaxPayload())
+
+	body := make([]byte, chunkSize*40)
+	_, err := rand.Read(body)
+	assert.Nil(t, err)
+
+	var written atomic.Int64
+	writeErr := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Get("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Transfer-Encoding", "chunked")
+		for offset := 0; offset < len(body); offset += chunkSize {
+			n, err := w.Write(body[offset : offset+chunkSize])
+			if err != nil {
+				writeErr <- err
+				return
+			}
+			written.Add(int64(n))
+		}
+		writeErr <- nil
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	transport := &Transport{Conn: conn, ChunkWindow: 2}
+
+	t.Run("slow", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/download", nil)
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// the handler should be paused once the window has been exhausted
+		<-time.After(300 * time.Millisecond)
+		assert.Less(t, written.Load(), int64(chunkSize*8))
+
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, b)
+		assert.Nil(t, resp.Body.Close())
+		assert.Nil(t, <-writeErr)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/download", nil)
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+
+		// read a little then stop
+		_, err = io.ReadFull(resp.Body, make([]byte, 1024))
+		assert.Nil(t, err)
+		assert.Nil(t, resp.Body.Close())
+
+		select {
+		case err = <-writeErr:
+			assert.ErrorIs(t, err, ErrReceiverClosed)
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler was not informed the client stopped reading")
+		}
+	})
+}
+
+func TestFlowControl_Echo(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the body exceeds the default window in both directions, so the response must be consumed whilst the request
+	// body is still being sent
+	body := make([]byte, int(conn.MaxPayload())*DefaultChunkWindow*2)
+	_, err := rand.Read(body)
+	assert.Nil(t, err)
+
+	routes := chi.NewRouter()
+	routes.Put("/echo", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	runProxy(t, routes, listener, conn, "", ctx)
+
+	assertEcho := func(t *testing.T, resp *http.Response, err error) {
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, b)
+		assert.Nil(t, resp.Body.Close())
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodPut, "nats+http://"+subject+"/echo", bytes.NewReader(body))
+		assert.Nil(t, err)
+
+		resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+		assertEcho(t, resp, err)
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodPut, "http://"+listener.Addr().String()+"/echo", bytes.NewReader(body))
+		assert.Nil(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		// HTTP/1 does not allow the response to start whilst the body is being sent, so the proxy only buffers a
+		// small remainder of the body before cutting the upload short and closing the connection
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Less(t, len(b), len(body))
+		assert.True(t, resp.Close)
+		assert.Nil(t, resp.Body.Close())
+	})
+}
@@ -0,0 +1,166 @@
+package natshttp
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	headerConnection     = "Connection"
+	headerUpgrade        = "Upgrade"
+	headerTE             = "Te"
+	headerForwarded      = "Forwarded"
+	headerForwardedFor   = "X-Forwarded-For"
+	headerForwardedHost  = "X-Forwarded-Host"
+	headerForwardedProto = "X-Forwarded-Proto"
+)
+
+// hopHeaders only apply to a single connection and must not be forwarded by a proxy, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	headerConnection,
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	headerTE,
+	headerTrailer,
+	"Transfer-Encoding",
+	headerUpgrade,
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, along with any others listed in its Connection header. A
+// protocol upgrade is the exception, for which Connection and Upgrade are kept so the server can switch protocols.
+func removeHopHeaders(h http.Header) {
+	upgrade := upgradeType(h)
+
+	for _, value := range h.Values(headerConnection) {
+		for _, key := range strings.Split(value, ",") {
+			if key = textproto.TrimString(key); key != "" {
+				h.Del(key)
+			}
+		}
+	}
+
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+
+	if upgrade != "" {
+		h.Set(headerConnection, headerUpgrade)
+		h.Set(headerUpgrade, upgrade)
+	}
+}
+
+// upgradeType returns the protocol requested in the Upgrade header, or an empty string if h does not request an
+// upgrade.
+func upgradeType(h http.Header) string {
+	if !headerContainsToken(h, headerConnection, "upgrade") {
+		return ""
+	}
+	return h.Get(headerUpgrade)
+}
+
+func headerContainsToken(h http.Header, key string, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setForwardedHeaders adds the client which sent req to the X-Forwarded-* and Forwarded headers in h. Values from
+// proxies the request has already passed through are only kept if the client is one of trusted, as they could
+// otherwise have been forged by the client.
+func setForwardedHeaders(h http.Header, req *http.Request, trusted []netip.Prefix) {
+	addr := remoteAddr(req)
+
+	if !isTrusted(addr, trusted) {
+		for _, key := range []string{headerForwarded, headerForwardedFor, headerForwardedHost, headerForwardedProto} {
+			h.Del(key)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	forwardedFor := h.Values(headerForwardedFor)
+	if addr.IsValid() {
+		forwardedFor = append(forwardedFor, addr.String())
+	}
+	if len(forwardedFor) > 0 {
+		h.Set(headerForwardedFor, strings.Join(forwardedFor, ", "))
+	}
+
+	if h.Get(headerForwardedHost) == "" {
+		h.Set(headerForwardedHost, req.Host)
+	}
+	if h.Get(headerForwardedProto) == "" {
+		h.Set(headerForwardedProto, proto)
+	}
+
+	node := "unknown"
+	if addr.Is6() {
+		node = "[" + addr.String() + "]"
+	} else if addr.IsValid() {
+		node = addr.String()
+	}
+
+	element := "for=" + quoteForwarded(node) + ";proto=" + proto
+	if req.Host != "" {
+		element += ";host=" + quoteForwarded(req.Host)
+	}
+
+	h.Set(headerForwarded, strings.Join(append(h.Values(headerForwarded), element), ", "))
+}
+
+// remoteAddr returns the address of the client which sent req, or an invalid address if it is not known.
+func remoteAddr(req *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteForwarded quotes a value of the Forwarded header unless it is a token, see RFC 7239 section 4.
+func quoteForwarded(value string) string {
+	for _, r := range value {
+		if !isTokenRune(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenRune(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	default:
+		return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+	}
+}
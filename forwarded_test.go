@@ -0,0 +1,166 @@
+package natshttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		header     http.Header
+		expected   http.Header
+	}{
+		{
+			name:       "untrusted",
+			remoteAddr: "192.0.2.1:1234",
+			header: http.Header{
+				headerForwarded:      {"for=203.0.113.1"},
+				headerForwardedFor:   {"203.0.113.1"},
+				headerForwardedHost:  {"forged.example.com"},
+				headerForwardedProto: {"https"},
+			},
+			expected: http.Header{
+				headerForwarded:      {"for=192.0.2.1;proto=http;host=example.com"},
+				headerForwardedFor:   {"192.0.2.1"},
+				headerForwardedHost:  {"example.com"},
+				headerForwardedProto: {"http"},
+			},
+		},
+		{
+			name:       "trusted",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				headerForwarded:      {"for=203.0.113.1;host=public.example.com;proto=https"},
+				headerForwardedFor:   {"203.0.113.1"},
+				headerForwardedHost:  {"public.example.com"},
+				headerForwardedProto: {"https"},
+			},
+			expected: http.Header{
+				headerForwarded: {
+					"for=203.0.113.1;host=public.example.com;proto=https, for=10.0.0.1;proto=http;host=example.com",
+				},
+				headerForwardedFor:   {"203.0.113.1, 10.0.0.1"},
+				headerForwardedHost:  {"public.example.com"},
+				headerForwardedProto: {"https"},
+			},
+		},
+		{
+			name:       "ipv6 and tls",
+			remoteAddr: "[2001:db8::1]:1234",
+			tls:        true,
+			header:     http.Header{},
+			expected: http.Header{
+				headerForwarded:      {`for="[2001:db8::1]";proto=https;host=example.com`},
+				headerForwardedFor:   {"2001:db8::1"},
+				headerForwardedHost:  {"example.com"},
+				headerForwardedProto: {"https"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			setForwardedHeaders(tc.header, req, trusted)
+			assert.Equal(t, tc.expected, tc.header)
+		})
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	as := assert.New(t)
+
+	h := http.Header{
+		"Connection":        {"keep-alive, X-Secret"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"X-Secret":          {"abc"},
+		"X-Request-Id":      {"123"},
+	}
+	removeHopHeaders(h)
+	as.Equal(http.Header{"X-Request-Id": {"123"}}, h)
+
+	// upgrades must survive so the server can switch protocols
+	h = http.Header{
+		"Connection": {"keep-alive, Upgrade"},
+		"Upgrade":    {"websocket"},
+		"Keep-Alive": {"timeout=5"},
+	}
+	removeHopHeaders(h)
+	as.Equal(http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, h)
+}
+
+func TestProxy_Forwarded(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{
+			headerForwarded, headerForwardedFor, headerForwardedHost, headerForwardedProto, "Keep-Alive", "X-Secret",
+		} {
+			w.Header().Set("X-Echo-"+key, r.Header.Get(key))
+		}
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "abc")
+	}), conn, ctx)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	proxy := &Proxy{
+		Subject:   subject,
+		Transport: &Transport{Conn: conn},
+		Listener:  listener,
+	}
+
+	go func() {
+		_ = proxy.Listen(ctx)
+	}()
+
+	as := assert.New(t)
+
+	host := listener.Addr().String()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", host), nil)
+	as.Nil(err)
+	req.Header.Set("Connection", "X-Secret")
+	req.Header.Set("X-Secret", "abc")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set(headerForwardedFor, "203.0.113.1")
+
+	resp, err := http.DefaultClient.Do(req)
+	as.Nil(err)
+	as.Equal(http.StatusOK, resp.StatusCode)
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	// the client is not a trusted proxy, so its forwarded headers are replaced
+	as.Equal("127.0.0.1", resp.Header.Get("X-Echo-"+headerForwardedFor))
+	as.Equal(host, resp.Header.Get("X-Echo-"+headerForwardedHost))
+	as.Equal("http", resp.Header.Get("X-Echo-"+headerForwardedProto))
+	as.Equal(`for=127.0.0.1;proto=http;host="`+host+`"`, resp.Header.Get("X-Echo-"+headerForwarded))
+
+	// hop-by-hop headers are not forwarded in either direction
+	as.Empty(resp.Header.Get("X-Echo-Keep-Alive"))
+	as.Empty(resp.Header.Get("X-Echo-X-Secret"))
+	as.Empty(resp.Header.Get("X-Internal"))
+}
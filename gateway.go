@@ -0,0 +1,95 @@
+package natshttp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+const (
+	ErrNoUpstream = errors.ConstError("natshttp: gateway has no upstream")
+)
+
+// Gateway is a http.Handler for a Server which forwards the requests it receives to an upstream HTTP service, the
+// reverse of a Proxy. This allows an existing service to be exposed on a subject hierarchy without any changes.
+// Request and response bodies are streamed, trailers are preserved in both directions and the upstream is informed
+// of the client with X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers. Any NATS publisher can set these
+// headers, so the values received with a request, and the NATS client itself, are only passed on if the Server has been
+// configured with TrustClientInfo. Otherwise they are replaced.
+type Gateway struct {
+	// Upstream is the URL requests are forwarded to, with the path of each request joined to its path. Requests are
+	// rejected with a 500 Internal Server Error if it is not set.
+	Upstream *url.URL
+	// Transport is used for making requests to Upstream. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	// ErrorHandler is called if Upstream cannot be reached. Defaults to responding with a 502 Bad Gateway.
+	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+
+	once  sync.Once
+	proxy *httputil.ReverseProxy
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if g.Upstream == nil {
+		http.Error(w, ErrNoUpstream.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	g.once.Do(func() {
+		g.proxy = &httputil.ReverseProxy{
+			Rewrite:      g.rewrite,
+			Transport:    g.Transport,
+			ErrorHandler: g.ErrorHandler,
+			// responses are flushed as they are received, so that streams are not held up
+			FlushInterval: -1,
+		}
+	})
+	g.proxy.ServeHTTP(w, req)
+}
+
+func (g *Gateway) rewrite(pr *httputil.ProxyRequest) {
+	pr.SetURL(g.Upstream)
+
+	// the request is cloned along with its trailer, which must instead be shared as it is only populated once the
+	// body has been read
+	pr.Out.Trailer = pr.In.Trailer
+
+	// protocol headers have already been removed by the Server
+	h := pr.Out.Header
+
+	srv, _ := ServerFromContext(pr.In.Context())
+	if srv == nil || !srv.TrustClientInfo {
+		// without RemoteAddr the client is unknown, and anything it claims about where the request came from is dropped
+		h.Del(headerForwarded)
+		h.Set(headerForwardedHost, pr.In.Host)
+		h.Set(headerForwardedProto, "http")
+		return
+	}
+
+	// the request may have passed through a Proxy already, in which case its information about the client is kept
+	// and the NATS client is added to the chain
+	forwardedFor := pr.In.Header.Values(headerForwardedFor)
+	if ip, _, err := net.SplitHostPort(pr.In.RemoteAddr); err == nil {
+		forwardedFor = append(forwardedFor, ip)
+	}
+	if len(forwardedFor) > 0 {
+		h.Set(headerForwardedFor, strings.Join(forwardedFor, ", "))
+	}
+
+	if host := pr.In.Header.Get(headerForwardedHost); host != "" {
+		h.Set(headerForwardedHost, host)
+	} else {
+		h.Set(headerForwardedHost, pr.In.Host)
+	}
+
+	if proto := pr.In.Header.Get(headerForwardedProto); proto != "" {
+		h.Set(headerForwardedProto, proto)
+	} else {
+		h.Set(headerForwardedProto, "http")
+	}
+}
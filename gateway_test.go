@@ -0,0 +1,248 @@
+package natshttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateway(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/base/headers":
+			for _, key := range []string{
+				headerForwardedFor, headerForwardedHost, headerForwardedProto, headerForwarded, HeaderPath, HeaderCancelSubject,
+				HeaderClientID, HeaderClientName, HeaderClientIP,
+			} {
+				w.Header().Set("X-Echo-"+key, r.Header.Get(key))
+			}
+			_, _ = io.WriteString(w, r.URL.RequestURI())
+
+		case "/base/echo":
+			// the body is read in full first as the upstream does not support full duplex
+			b, err := io.ReadAll(r.Body)
+			assert.Nil(t, err)
+			w.Header().Set("Trailer", "X-Size")
+			_, _ = w.Write(b)
+			w.Header().Set("X-Size", strconv.Itoa(len(b)))
+			w.Header().Set(http.TrailerPrefix+"X-Request-Trailer", r.Trailer.Get("X-Checksum"))
+
+		case "/base/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			for idx := 0; idx < 3; idx++ {
+				<-next
+				_, _ = io.WriteString(w, "data: "+strconv.Itoa(idx)+"\n\n")
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	upstreamUrl, err := url.Parse(upstream.URL + "/base")
+	assert.Nil(t, err)
+
+	gateway := &Gateway{Upstream: upstreamUrl}
+
+	srv := &Server{
+		Conn:            conn,
+		Subject:         subject,
+		Handler:         gateway,
+		TrustClientInfo: true,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	// client info is not trusted by default
+	untrusted := &Server{
+		Conn:    conn,
+		Subject: "untrusted",
+		Handler: gateway,
+	}
+
+	go func() {
+		_ = untrusted.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	for i := 0; i < 100; i++ {
+		if _, err := conn.Request("untrusted.HEAD", nil, time.Second); err != nats.ErrNoResponders {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	transport := &Transport{Conn: conn}
+
+	t.Run("headers", func(t *testing.T) {
+		as := assert.New(t)
+
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/headers?foo=bar", nil)
+		as.Nil(err)
+
+		resp, err := transport.RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		as.Nil(err)
+		as.Equal("/base/headers?foo=bar", string(b))
+
+		ip, err := conn.GetClientIP()
+		as.Nil(err)
+
+		as.Equal(ip.String(), resp.Header.Get("X-Echo-"+headerForwardedFor))
+		as.Equal(subject, resp.Header.Get("X-Echo-"+headerForwardedHost))
+		as.Equal("http", resp.Header.Get("X-Echo-"+headerForwardedProto))
+
+		// protocol headers are not forwarded
+		as.Empty(resp.Header.Get("X-Echo-" + HeaderPath))
+		as.Empty(resp.Header.Get("X-Echo-" + HeaderCancelSubject))
+		as.Empty(resp.Header.Get("X-Echo-" + HeaderClientID))
+		as.Empty(resp.Header.Get("X-Echo-" + HeaderClientName))
+		as.Empty(resp.Header.Get("X-Echo-" + HeaderClientIP))
+
+		// information from proxies the request has already passed through is kept
+		req, err = http.NewRequest(http.MethodGet, "nats+http://"+subject+"/headers", nil)
+		as.Nil(err)
+		req.Header.Set(headerForwardedFor, "203.0.113.1")
+		req.Header.Set(headerForwardedHost, "example.com")
+		req.Header.Set(headerForwardedProto, "https")
+
+		resp, err = transport.RoundTrip(req)
+		as.Nil(err)
+
+		as.Equal("203.0.113.1, "+ip.String(), resp.Header.Get("X-Echo-"+headerForwardedFor))
+		as.Equal("example.com", resp.Header.Get("X-Echo-"+headerForwardedHost))
+		as.Equal("https", resp.Header.Get("X-Echo-"+headerForwardedProto))
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		as := assert.New(t)
+
+		// forwarded headers set by the client are replaced, as any NATS publisher can set them
+		req, err := http.NewRequest(http.MethodGet, "nats+http://untrusted/headers", nil)
+		as.Nil(err)
+		req.Header.Set(headerForwardedFor, "203.0.113.1")
+		req.Header.Set(headerForwardedHost, "example.com")
+		req.Header.Set(headerForwardedProto, "https")
+		req.Header.Set(headerForwarded, "for=203.0.113.1")
+
+		resp, err := transport.RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+
+		as.Empty(resp.Header.Get("X-Echo-" + headerForwardedFor))
+		as.Equal("untrusted", resp.Header.Get("X-Echo-"+headerForwardedHost))
+		as.Equal("http", resp.Header.Get("X-Echo-"+headerForwardedProto))
+		as.Empty(resp.Header.Get("X-Echo-" + headerForwarded))
+	})
+
+	t.Run("streaming body and trailers", func(t *testing.T) {
+		as := assert.New(t)
+
+		body := make([]byte, conn.MaxPayload()*3)
+		_, err := rand.Read(body)
+		as.Nil(err)
+
+		req, err := http.NewRequest(http.MethodPost, "nats+http://"+subject+"/echo", bytes.NewReader(body))
+		as.Nil(err)
+		req.Trailer = http.Header{"X-Checksum": []string{"abc"}}
+
+		resp, err := transport.RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		as.Nil(err)
+		as.Equal(body, b)
+
+		as.Equal(strconv.Itoa(len(body)), resp.Trailer.Get("X-Size"))
+		as.Equal("abc", resp.Trailer.Get("X-Request-Trailer"))
+	})
+
+	t.Run("events", func(t *testing.T) {
+		as := assert.New(t)
+
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/events", nil)
+		as.Nil(err)
+
+		// the response starts once the upstream has sent its headers
+		go func() {
+			next <- struct{}{}
+		}()
+
+		resp, err := transport.RoundTrip(req)
+		as.Nil(err)
+		as.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+		reader := bufio.NewReader(resp.Body)
+		for idx := 0; idx < 3; idx++ {
+			if idx > 0 {
+				// each event is received before the next is sent
+				next <- struct{}{}
+			}
+			line, err := reader.ReadString('\n')
+			as.Nil(err)
+			as.Equal("data: "+strconv.Itoa(idx)+"\n", line)
+			_, _ = reader.ReadString('\n')
+		}
+
+		_, err = reader.ReadByte()
+		as.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+
+		unreachable, err := url.Parse(srv.URL)
+		assert.Nil(t, err)
+
+		var upstreamErr error
+		gateway := &Gateway{
+			Upstream: unreachable,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				upstreamErr = err
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.NotNil(t, upstreamErr)
+	})
+}
+
+func TestGateway_NoUpstream(t *testing.T) {
+	as := assert.New(t)
+
+	w := httptest.NewRecorder()
+	(&Gateway{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+
+	as.Equal(http.StatusInternalServerError, w.Code)
+	as.Equal(ErrNoUpstream.Error()+"\n", w.Body.String())
+}
@@ -3,7 +3,9 @@ package natshttp
 import (
 	"context"
 	"net"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -12,20 +14,20 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-func runBasicNatsServer(t *testing.T) *server.Server {
+func runBasicNatsServer(t testing.TB) *server.Server {
 	t.Helper()
 	opts := test.DefaultTestOptions
 	opts.Port = -1
 	return test.RunServer(&opts)
 }
 
-func shutdownNatsServer(t *testing.T, s *server.Server) {
+func shutdownNatsServer(t testing.TB, s *server.Server) {
 	t.Helper()
 	s.Shutdown()
 	s.WaitForShutdown()
 }
 
-func client(t *testing.T, s *server.Server, opts ...nats.Option) *nats.Conn {
+func client(t testing.TB, s *server.Server, opts ...nats.Option) *nats.Conn {
 	t.Helper()
 	nc, err := nats.Connect(s.ClientURL(), opts...)
 	if err != nil {
@@ -48,6 +50,8 @@ func runProxy(t *testing.T, router chi.Router, listener net.Listener, conn *nats
 		_ = srv.Listen(ctx)
 	}()
 
+	waitForResponders(t, conn)
+
 	proxy := Proxy{
 		Subject: subject,
 		Transport: &Transport{
@@ -60,3 +64,34 @@ func runProxy(t *testing.T, router chi.Router, listener net.Listener, conn *nats
 		_ = proxy.Listen(ctx)
 	}()
 }
+
+func runServer(t testing.TB, handler http.Handler, conn *nats.Conn, ctx context.Context) {
+	t.Helper()
+
+	srv := Server{
+		Conn:    conn,
+		Subject: subject,
+		Handler: handler,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+}
+
+// waitForResponders blocks until the server is subscribed to the test subject.
+func waitForResponders(t testing.TB, conn *nats.Conn) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		_, err := conn.Request(subject+".HEAD", nil, time.Second)
+		if err != nats.ErrNoResponders {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timed out waiting for responders")
+}
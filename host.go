@@ -0,0 +1,59 @@
+package natshttp
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// virtualHost is a subject prefix on which a Server receives requests, and the handler for them.
+type virtualHost struct {
+	prefix  string
+	handler http.Handler
+}
+
+// virtualHosts combines Subject and Hosts, ensuring no two prefixes overlap as requests would otherwise be received
+// more than once.
+func (s *Server) virtualHosts() ([]virtualHost, error) {
+	var hosts []virtualHost
+	if s.Subject != "" {
+		hosts = append(hosts, virtualHost{prefix: s.Subject, handler: s.Handler})
+	}
+
+	for prefix, handler := range s.Hosts {
+		if prefix == "" {
+			return nil, errors.New("natshttp: Server.Hosts cannot contain an empty prefix")
+		}
+		if handler == nil {
+			return nil, errors.Errorf("natshttp: Server.Hosts handler for '%s' cannot be nil", prefix)
+		}
+		hosts = append(hosts, virtualHost{prefix: prefix, handler: handler})
+	}
+
+	// sorted for a deterministic order of subscription and error reporting
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].prefix < hosts[j].prefix
+	})
+
+	for i, a := range hosts {
+		for _, b := range hosts[i+1:] {
+			if a.prefix == b.prefix || strings.HasPrefix(b.prefix, a.prefix+".") {
+				return nil, errors.Errorf("natshttp: Server hosts '%s' and '%s' overlap", a.prefix, b.prefix)
+			}
+		}
+	}
+
+	return hosts, nil
+}
+
+// host returns the virtual host which received a request on subject.
+func (s *Server) host(subject string) (virtualHost, bool) {
+	for _, host := range s.hosts {
+		if strings.HasPrefix(subject, host.prefix+".") {
+			return host, true
+		}
+	}
+	return virtualHost{}, false
+}
@@ -0,0 +1,95 @@
+package natshttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_Hosts(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+" "+r.Host+" "+r.URL.Path)
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		as := assert.New(t)
+
+		srv := &Server{Conn: conn}
+		as.EqualError(srv.Listen(context.Background()), "natshttp: Server.Subject cannot be empty")
+
+		srv = &Server{Conn: conn, Hosts: map[string]http.Handler{"svc.a": nil}}
+		as.EqualError(srv.Listen(context.Background()), "natshttp: Server.Hosts handler for 'svc.a' cannot be nil")
+
+		srv = &Server{
+			Conn:    conn,
+			Subject: "svc",
+			Handler: handler("default"),
+			Hosts:   map[string]http.Handler{"svc-b": handler("b"), "svc.a": handler("a")},
+		}
+		as.EqualError(srv.Listen(context.Background()), "natshttp: Server hosts 'svc' and 'svc.a' overlap")
+	})
+
+	srv := &Server{
+		Conn:    conn,
+		Subject: subject,
+		Handler: handler("default"),
+		Hosts: map[string]http.Handler{
+			"svc.a": handler("a"),
+			"svc.b": handler("b"),
+		},
+		MaxConcurrentRequests: 2,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Listen(context.Background())
+	}()
+
+	waitForResponders(t, conn)
+
+	transport := &Transport{Conn: conn}
+
+	for host, expected := range map[string]string{
+		subject: "default " + subject + " /foo",
+		"svc.a": "a svc.a /foo",
+		"svc.b": "b svc.b /foo",
+	} {
+		t.Run(host, func(t *testing.T) {
+			as := assert.New(t)
+
+			req, err := http.NewRequest(http.MethodGet, "nats+http://"+host+"/foo", nil)
+			as.Nil(err)
+
+			resp, err := transport.RoundTrip(req)
+			as.Nil(err)
+			as.Equal(http.StatusOK, resp.StatusCode)
+
+			b, err := io.ReadAll(resp.Body)
+			as.Nil(err)
+			as.Equal(expected, string(b))
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// every subscription is drained
+	assert.Nil(t, srv.Shutdown(ctx))
+	assert.ErrorIs(t, <-errs, ErrServerClosed)
+
+	for _, host := range []string{subject, "svc.a", "svc.b"} {
+		_, err := conn.Request(host+".foo.GET", nil, time.Second)
+		assert.ErrorIs(t, err, nats.ErrNoResponders)
+	}
+}
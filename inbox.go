@@ -0,0 +1,217 @@
+package natshttp
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	ErrInboxClosed = errors.ConstError("natshttp: inbox has been closed")
+)
+
+// Subscription is the subset of *nats.Subscription required for receiving a stream of msgs.
+type Subscription interface {
+	NextMsgWithContext(ctx context.Context) (*nats.Msg, error)
+	Unsubscribe() error
+}
+
+// inboxMux owns a single wildcard subscription and demultiplexes the msgs it receives to in-flight requests based on
+// the last token of the subject, in a similar fashion to how nats.Conn.Request works.
+type inboxMux struct {
+	conn   *nats.Conn
+	prefix string
+	sub    *nats.Subscription
+
+	pendingMsgsLimit  int
+	pendingBytesLimit int
+
+	nextToken atomic.Uint64
+
+	lock    sync.RWMutex
+	inboxes map[string]*respInbox
+	closed  bool
+}
+
+func newInboxMux(conn *nats.Conn, pendingMsgsLimit int, pendingBytesLimit int) (*inboxMux, error) {
+	mux := &inboxMux{
+		conn:              conn,
+		prefix:            conn.NewInbox(),
+		pendingMsgsLimit:  pendingMsgsLimit,
+		pendingBytesLimit: pendingBytesLimit,
+		inboxes:           make(map[string]*respInbox),
+	}
+
+	sub, err := conn.Subscribe(mux.prefix+".*", mux.onMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	// the callback never blocks, limits are instead enforced per inbox
+	if err = sub.SetPendingLimits(-1, -1); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	mux.sub = sub
+
+	return mux, nil
+}
+
+func (m *inboxMux) onMsg(msg *nats.Msg) {
+	token := msg.Subject[len(m.prefix)+1:]
+
+	m.lock.RLock()
+	ib, ok := m.inboxes[token]
+	m.lock.RUnlock()
+
+	// msgs for requests which are no longer in-flight are dropped
+	if ok {
+		ib.deliver(msg)
+	}
+}
+
+// NewInbox registers a new inbox with the mux. It must be closed with Unsubscribe when no longer required. If the mux
+// has been closed the inbox fails with ErrInboxClosed, as it would never receive a msg.
+func (m *inboxMux) NewInbox() *respInbox {
+	token := strconv.FormatUint(m.nextToken.Add(1), 36)
+
+	ib := &respInbox{
+		mux:     m,
+		token:   token,
+		Subject: m.prefix + "." + token,
+		signal:  make(chan struct{}, 1),
+	}
+
+	m.lock.Lock()
+	if m.closed {
+		ib.err = ErrInboxClosed
+	} else {
+		m.inboxes[token] = ib
+	}
+	m.lock.Unlock()
+
+	return ib
+}
+
+func (m *inboxMux) remove(token string) {
+	m.lock.Lock()
+	delete(m.inboxes, token)
+	m.lock.Unlock()
+}
+
+// Close unsubscribes from the wildcard subject, failing any inboxes which are still registered with ErrInboxClosed.
+func (m *inboxMux) Close() error {
+	err := m.sub.Unsubscribe()
+
+	m.lock.Lock()
+	inboxes := m.inboxes
+	m.inboxes = make(map[string]*respInbox)
+	m.closed = true
+	m.lock.Unlock()
+
+	for _, ib := range inboxes {
+		ib.close()
+	}
+
+	return err
+}
+
+// respInbox is the receiving end of a single subject within an inboxMux and implements Subscription.
+type respInbox struct {
+	Subject string
+
+	mux   *inboxMux
+	token string
+
+	lock         sync.Mutex
+	pending      []*nats.Msg
+	pendingBytes int
+	err          error
+
+	signal chan struct{}
+}
+
+func (i *respInbox) deliver(msg *nats.Msg) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.err != nil {
+		return
+	}
+
+	i.pending = append(i.pending, msg)
+	i.pendingBytes += len(msg.Data)
+
+	m := i.mux
+	if (m.pendingMsgsLimit > 0 && len(i.pending) > m.pendingMsgsLimit) ||
+		(m.pendingBytesLimit > 0 && i.pendingBytes > m.pendingBytesLimit) {
+		i.err = nats.ErrSlowConsumer
+	}
+
+	select {
+	case i.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (i *respInbox) NextMsgWithContext(ctx context.Context) (*nats.Msg, error) {
+	for {
+		if msg, err := i.nextPending(); msg != nil || err != nil {
+			return msg, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-i.signal:
+		}
+	}
+}
+
+// nextPending returns the next msg which has already been received, or nil if there is none.
+func (i *respInbox) nextPending() (*nats.Msg, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.err != nil {
+		return nil, i.err
+	}
+	if len(i.pending) == 0 {
+		return nil, nil
+	}
+
+	msg := i.pending[0]
+	i.pending[0] = nil
+	i.pending = i.pending[1:]
+	i.pendingBytes -= len(msg.Data)
+
+	return msg, nil
+}
+
+func (i *respInbox) Unsubscribe() error {
+	i.mux.remove(i.token)
+	i.close()
+	return nil
+}
+
+// close discards any pending msgs and wakes up a receiver which is waiting for the next one.
+func (i *respInbox) close() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if i.err == nil {
+		i.err = ErrInboxClosed
+	}
+	i.pending = nil
+	i.pendingBytes = 0
+
+	select {
+	case i.signal <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,161 @@
+package natshttp
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboxMux(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	mux, err := newInboxMux(conn, 2, -1)
+	assert.Nil(t, err)
+	defer func() { _ = mux.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var inboxes []*respInbox
+	for i := 0; i < 10; i++ {
+		inboxes = append(inboxes, mux.NewInbox())
+	}
+
+	// publish in reverse order to ensure msgs are routed by subject
+	for i := len(inboxes) - 1; i >= 0; i-- {
+		assert.Nil(t, conn.Publish(inboxes[i].Subject, []byte(strconv.Itoa(i))))
+	}
+
+	for i, inbox := range inboxes {
+		msg, err := inbox.NextMsgWithContext(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(i), string(msg.Data))
+		assert.Nil(t, inbox.Unsubscribe())
+	}
+
+	assert.Empty(t, mux.inboxes)
+
+	t.Run("slow consumer", func(t *testing.T) {
+		inbox := mux.NewInbox()
+		defer func() { _ = inbox.Unsubscribe() }()
+
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, conn.Publish(inbox.Subject, []byte(strconv.Itoa(i))))
+		}
+		assert.Nil(t, conn.Flush())
+
+		// wait for delivery
+		<-time.After(100 * time.Millisecond)
+
+		_, err = inbox.NextMsgWithContext(ctx)
+		assert.ErrorIs(t, err, nats.ErrSlowConsumer)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		inbox := mux.NewInbox()
+		assert.Nil(t, inbox.Unsubscribe())
+
+		_, err = inbox.NextMsgWithContext(ctx)
+		assert.ErrorIs(t, err, ErrInboxClosed)
+	})
+
+	t.Run("mux closed", func(t *testing.T) {
+		mux, err := newInboxMux(conn, -1, -1)
+		assert.Nil(t, err)
+
+		inbox := mux.NewInbox()
+		errs := make(chan error, 1)
+		go func() {
+			// no deadline, so only closing the mux can wake the receiver
+			_, err := inbox.NextMsgWithContext(context.Background())
+			errs <- err
+		}()
+
+		<-time.After(50 * time.Millisecond)
+		assert.Nil(t, mux.Close())
+
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, ErrInboxClosed)
+		case <-time.After(5 * time.Second):
+			t.Fatal("receiver was not woken when the mux was closed")
+		}
+		assert.Empty(t, mux.inboxes)
+
+		// inboxes created after the mux has been closed fail straight away rather than waiting forever
+		_, err = mux.NewInbox().NextMsgWithContext(context.Background())
+		assert.ErrorIs(t, err, ErrInboxClosed)
+		assert.Empty(t, mux.inboxes)
+	})
+}
+
+// BenchmarkInbox compares receiving replies via the shared inbox mux against creating a subscription per request.
+func BenchmarkInbox(b *testing.B) {
+	s := runBasicNatsServer(b)
+	defer shutdownNatsServer(b, s)
+
+	conn := client(b, s)
+	defer conn.Close()
+
+	echo, err := conn.Subscribe("bench.echo", func(msg *nats.Msg) {
+		_ = msg.Respond(msg.Data)
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = echo.Unsubscribe() }()
+
+	ctx := context.Background()
+	data := []byte("hello world")
+
+	b.Run("shared", func(b *testing.B) {
+		mux, err := newInboxMux(conn, -1, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer func() { _ = mux.Close() }()
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				inbox := mux.NewInbox()
+				if err := conn.PublishRequest("bench.echo", inbox.Subject, data); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := inbox.NextMsgWithContext(ctx); err != nil {
+					b.Error(err)
+					return
+				}
+				_ = inbox.Unsubscribe()
+			}
+		})
+	})
+
+	b.Run("per-request", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				inbox := conn.NewRespInbox()
+				sub, err := conn.SubscribeSync(inbox)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if err := conn.PublishRequest("bench.echo", inbox, data); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := sub.NextMsgWithContext(ctx); err != nil {
+					b.Error(err)
+					return
+				}
+				_ = sub.Unsubscribe()
+			}
+		})
+	})
+}
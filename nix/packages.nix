@@ -9,7 +9,7 @@
       version = "0.0.1+dev";
 
       src = ../.;
-      vendorSha256 = "sha256-bbACDGInMCjQjO/ST0Ty2aI3GhHkSTQqTPl6OqLVI1c=";
+      vendorSha256 = "sha256-zi7MCOwFCgre1cLBvgLObEl2i6MnHu9mNakf1GpNKxM=";
 
       postInstall = ''
         # run test coverage
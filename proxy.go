@@ -1,28 +1,127 @@
 package natshttp
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"sync"
+	"sync/atomic"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-http-utils/headers"
 	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
 	"golang.org/x/sync/errgroup"
 )
 
 type Proxy struct {
+	// Subject is the default route, to which requests not matched by any of Routes are forwarded.
 	Subject   string
 	Transport *Transport
 	Listener  net.Listener
+
+	// Routes forward requests to different subjects based on their host and path. Routes for a specific host take
+	// precedence over those for any host, after which the route with the longest matching path prefix is selected.
+	// Requests which match no route are forwarded to Subject if set, and are otherwise rejected with a 404 Not Found.
+	// Use SetRoutes to change the routes once the Proxy is running.
+	Routes []Route
+
+	// ErrorHandler is called if a request cannot be forwarded or no response is received, and is responsible for
+	// responding to the client. ErrorStatus can be used to determine an appropriate status code. Defaults to
+	// responding with that status code and its status text. Failures after the response has started cannot be
+	// reported to the client, so the connection to it is aborted instead.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, err error)
+
+	// TrustedProxies are the addresses of proxies in front of this one. The X-Forwarded-* and Forwarded headers of
+	// requests from a trusted proxy are appended to, whereas for any other client they are replaced, as they could
+	// otherwise have been forged.
+	TrustedProxies []netip.Prefix
+
+	table atomic.Pointer[routingTable]
+}
+
+// ErrorStatus returns the status code with which a Proxy responds to a request which failed with err.
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoRoute):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNoResponders), errors.Is(err, nats.ErrNoResponders):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrInvalidRoute), errors.Is(err, ErrInvalidUrl), errors.Is(err, ErrNoHeaders):
+		// the proxy has been misconfigured
+		return http.StatusInternalServerError
+	default:
+		// the server has sent an invalid or incomplete response
+		return http.StatusBadGateway
+	}
+}
+
+func defaultProxyErrorHandler(w http.ResponseWriter, _ *http.Request, err error) {
+	code := ErrorStatus(err)
+	w.Header().Set(headers.ContentType, "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = io.WriteString(w, http.StatusText(code))
+}
+
+// error responds to a request which could not be forwarded, unless the client has already gone away.
+func (p *Proxy) error(w http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() != nil {
+		return
+	}
+
+	handler := p.ErrorHandler
+	if handler == nil {
+		handler = defaultProxyErrorHandler
+	}
+
+	handler(w, req, err)
+}
+
+// SetRoutes replaces the routes of the Proxy. Requests which are in-flight are not affected.
+func (p *Proxy) SetRoutes(routes []Route) error {
+	table, err := newRoutingTable(routes, p.Subject)
+	if err != nil {
+		return err
+	}
+	p.table.Store(table)
+	return nil
+}
+
+// routingTable returns the current routes, compiling Routes when first called.
+func (p *Proxy) routingTable() (*routingTable, error) {
+	if table := p.table.Load(); table != nil {
+		return table, nil
+	}
+
+	table, err := newRoutingTable(p.Routes, p.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	// routes set concurrently take precedence
+	if !p.table.CompareAndSwap(nil, table) {
+		table = p.table.Load()
+	}
+
+	return table, nil
 }
 
 func (p *Proxy) Listen(ctx context.Context) error {
-	if p.Subject == "" {
+	if p.Subject == "" && len(p.Routes) == 0 {
 		return errors.New("natshttp: Proxy.Subject cannot be empty")
 	}
 
+	if _, err := p.routingTable(); err != nil {
+		return err
+	}
+
 	if p.Transport == nil {
 		return errors.New("natshttp: Proxy.Transport cannot be empty")
 	}
@@ -58,42 +157,263 @@ func (p *Proxy) Listen(ctx context.Context) error {
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// todo better error handling
+	table, err := p.routingTable()
+	if err != nil {
+		p.error(w, req, err)
+		return
+	}
+
+	subject, path, err := table.match(req.Host, req.URL.Path)
+	if err != nil {
+		p.error(w, req, err)
+		return
+	}
+
+	header := req.Header.Clone()
+	removeHopHeaders(header)
+	if headerContainsToken(req.Header, headerTE, "trailers") {
+		// signals support for trailers to the server, rather than anything about this connection
+		header.Set(headerTE, "trailers")
+	}
+	setForwardedHeaders(header, req, p.TrustedProxies)
+
+	// HTTP/1 servers do not allow the request body to be read once the response has started, so a small remainder is
+	// drained before then, allowing the server to respond just before the body has been sent in full
+	var body *drainBody
+	if req.ProtoMajor < 2 && req.Body != nil && req.Body != http.NoBody {
+		body = &drainBody{ReadCloser: req.Body}
+		req.Body = body
+	}
 
 	proxyReq := &http.Request{
 		URL: &url.URL{
-			Host:     p.Subject,
+			Host:     subject,
 			Scheme:   UrlScheme,
-			Path:     req.URL.Path,
+			Path:     path,
 			RawQuery: req.URL.RawQuery,
 		},
 		Method: req.Method,
-		Header: req.Header,
+		Header: header,
 		Body:   req.Body,
 	}
 
 	proxyReq.ContentLength = req.ContentLength
 	proxyReq.TransferEncoding = req.TransferEncoding
+	proxyReq.Trailer = req.Trailer
+
+	// the request is cancelled if the client goes away
+	proxyReq = proxyReq.WithContext(req.Context())
 
 	resp, err := p.Transport.RoundTrip(proxyReq)
 	if err != nil {
-		w.WriteHeader(500)
-		_, _ = io.WriteString(w, err.Error())
+		p.error(w, req, err)
 		return
 	}
 
 	defer func() { _ = resp.Body.Close() }()
 
+	removeHopHeaders(resp.Header)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		p.switchProtocols(w, req, resp)
+		return
+	}
+
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
 
+	// the trailer is announced again, having been removed with the other hop-by-hop headers
+	if len(resp.Trailer) > 0 {
+		w.Header().Set(headerTrailer, trailerKeys(resp.Trailer))
+	}
+
+	if body != nil && !body.drain() {
+		w.Header().Set(headerConnection, "close")
+	}
+
 	w.WriteHeader(resp.StatusCode)
 
-	_, err = io.Copy(w, resp.Body)
+	err = copyResponse(w, resp)
+	if err != nil && req.Context().Err() != nil {
+		// the client has gone away
+		return
+	} else if err != nil {
+		// the response is incomplete, so the client must not mistake it for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	// the trailer is only populated once the body has been read to EOF
+	for key, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+key] = values
+	}
+}
+
+// maxDrainBytes bounds how much of a request body is buffered by drainBody, matching the amount an http.Server
+// discards before responding.
+const maxDrainBytes = 256 << 10
+
+// drainBody wraps the body of a client request so that whatever has not yet been read can be buffered in memory
+// before the response is written, after which reads are served from the buffer.
+type drainBody struct {
+	io.ReadCloser
+
+	lock    sync.Mutex
+	started bool
+	closed  bool
+	buf     *bytes.Buffer
+	err     error
+}
+
+func (b *drainBody) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.buf == nil {
+		b.started = true
+		return b.ReadCloser.Read(p)
+	}
+
+	n, err := b.buf.Read(p)
+	if err == io.EOF && b.err != nil {
+		err = b.err
+	}
+	return n, err
+}
+
+func (b *drainBody) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.ReadCloser.Close()
+}
+
+// drain reads up to maxDrainBytes of the rest of the body into memory, returning false if the body was larger and
+// has been closed, in which case the connection to the client cannot be reused. A body which has not been read at
+// all is left alone, as the server has responded without it and reading it would needlessly send a 100 Continue to
+// the client. Likewise a body which has been closed is no longer wanted by the server.
+func (b *drainBody) drain() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.started || b.closed || b.buf != nil {
+		return true
+	}
+
+	b.buf = new(bytes.Buffer)
+	n, err := io.CopyN(b.buf, b.ReadCloser, maxDrainBytes+1)
+	if err == io.EOF {
+		return true
+	} else if err != nil {
+		b.err = err
+		return true
+	}
+
+	if n > maxDrainBytes {
+		// the server is sent what has been buffered, followed by an error rather than a truncated body
+		b.err = ErrBodyAfterResponse
+		b.closed = true
+		_ = b.ReadCloser.Close()
+		return false
+	}
+
+	return true
+}
+
+// copyResponse copies the body of resp to w, flushing after every read so that streamed responses such as
+// server-sent events are delivered to the client as soon as each chunk arrives.
+func copyResponse(w http.ResponseWriter, resp *http.Response) error {
+	rc := http.NewResponseController(w)
+
+	// the body of a chunked response may take a while to arrive, so the headers are sent without waiting for it
+	if resp.ContentLength < 0 {
+		if err := rc.Flush(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// switchProtocols hijacks the connection of the client and joins it to the tunnel established with the server,
+// copying data in both directions until both sides have stopped writing.
+func (p *Proxy) switchProtocols(w http.ResponseWriter, req *http.Request, resp *http.Response) {
+	tunnel, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		p.error(w, req, errors.New("natshttp: protocol switch without a tunnel"))
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
-		panic(err)
+		p.error(w, req, err)
+		return
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	// the response head is written directly as the connection no longer belongs to the http server
+	_, _ = fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	_ = resp.Header.Write(brw)
+	_, _ = io.WriteString(brw, "\r\n")
+	if err = brw.Flush(); err != nil {
+		return
+	}
+
+	// each direction is closed for writing once the other end stops writing, so that data still in flight in the
+	// opposite direction is delivered
+	errs := make(chan error, 2)
+	go func() {
+		// anything the client sent after the request has been buffered by the http server
+		_, err := io.Copy(tunnel, brw.Reader)
+		if err == nil {
+			err = closeWrite(tunnel)
+		}
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, tunnel)
+		if err == nil {
+			err = closeWrite(conn)
+		}
+		errs <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			// a direction has failed, so the other is torn down rather than waiting for it to finish
+			_ = conn.Close()
+			_ = tunnel.Close()
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of c, or closes it completely if it does not support half-closing.
+func closeWrite(c io.Closer) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
 	}
+	return c.Close()
 }
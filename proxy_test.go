@@ -1,6 +1,7 @@
 package natshttp
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
@@ -9,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -272,3 +274,341 @@ func TestProxy_Chunked(t *testing.T) {
 		assert.Equal(t, body, b)
 	})
 }
+
+func TestProxy_ServerSentEvents(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the handler sends an event each time the test is ready for it, so each event must be delivered without
+	// waiting for any that follow
+	next := make(chan struct{})
+	done := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+
+		w.Header().Set(headers.ContentType, "text/event-stream")
+		w.Header().Set(headers.CacheControl, "no-cache")
+		if err := rc.Flush(); err != nil {
+			done <- err
+			return
+		}
+
+		for idx := 0; ; idx++ {
+			select {
+			case <-r.Context().Done():
+				done <- r.Context().Err()
+				return
+			case <-next:
+			}
+
+			_, _ = fmt.Fprintf(w, "id: %d\ndata: event %d\n\n", idx, idx)
+			if err := rc.Flush(); err != nil {
+				done <- err
+				return
+			}
+		}
+	})
+
+	srv := Server{
+		Conn:        conn,
+		Subject:     subject,
+		Handler:     routes,
+		Compression: SupportedCompression,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	proxy := Proxy{
+		Subject:   subject,
+		Transport: &Transport{Conn: conn},
+		Listener:  listener,
+	}
+
+	go func() {
+		_ = proxy.Listen(ctx)
+	}()
+
+	readEvents := func(t *testing.T, body io.Reader) {
+		as := assert.New(t)
+		reader := bufio.NewReader(body)
+
+		for idx := 0; idx < 20; idx++ {
+			next <- struct{}{}
+
+			var event string
+			for {
+				line, err := reader.ReadString('\n')
+				as.Nil(err)
+				if err != nil || line == "\n" {
+					break
+				}
+				event += line
+			}
+
+			as.Equal(fmt.Sprintf("id: %d\ndata: event %d\n", idx, idx), event)
+		}
+	}
+
+	awaitDisconnect := func(t *testing.T) {
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler was not cancelled after the client disconnected")
+		}
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		for _, disabled := range []bool{false, true} {
+			req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/events", nil)
+			assert.Nil(t, err)
+
+			resp, err := (&Transport{Conn: conn, DisableCompression: disabled}).RoundTrip(req)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "text/event-stream", resp.Header.Get(headers.ContentType))
+
+			readEvents(t, resp.Body)
+
+			assert.Nil(t, resp.Body.Close())
+			awaitDisconnect(t)
+		}
+	})
+
+	t.Run("proxy", func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/events", listener.Addr().String()))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get(headers.ContentType))
+		assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+		readEvents(t, resp.Body)
+
+		// disconnecting the client cancels the handler
+		assert.Nil(t, resp.Body.Close())
+		awaitDisconnect(t)
+	})
+}
+
+func TestProxy_Errors(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	routes.Get("/abort", func(w http.ResponseWriter, r *http.Request) {
+		body := make([]byte, conn.MaxPayload()*2)
+		_, _ = w.Write(body)
+		http.NewResponseController(w).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	// replies with a response the transport cannot parse
+	sub, err := conn.Subscribe("invalid.>", func(msg *nats.Msg) {
+		resp := nats.NewMsg(msg.Reply)
+		resp.Header.Set(HeaderStatusCode, "abc")
+		_ = msg.RespondMsg(resp)
+	})
+	assert.Nil(t, err)
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	proxy := &Proxy{
+		Transport: &Transport{Conn: conn, Timeout: 500 * time.Millisecond},
+		Listener:  listener,
+		Routes: []Route{
+			{PathPrefix: "/missing", Subject: "missing"},
+			{PathPrefix: "/invalid", Subject: "invalid"},
+			{PathPrefix: "/", Subject: subject},
+		},
+	}
+
+	go func() {
+		_ = proxy.Listen(ctx)
+	}()
+
+	baseUrl := fmt.Sprintf("http://%s", listener.Addr())
+
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/missing/foo", http.StatusServiceUnavailable},
+		{"/slow", http.StatusGatewayTimeout},
+		{"/invalid/foo", http.StatusBadGateway},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			as := assert.New(t)
+
+			resp, err := http.Get(baseUrl + tc.path)
+			as.Nil(err)
+			as.Equal(tc.code, resp.StatusCode)
+
+			// error details are not exposed to the client
+			b, err := io.ReadAll(resp.Body)
+			as.Nil(err)
+			as.Equal(http.StatusText(tc.code), string(b))
+		})
+	}
+
+	t.Run("error handler", func(t *testing.T) {
+		as := assert.New(t)
+
+		var proxyErr error
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			proxyErr = err
+			w.Header().Set(headers.ContentType, "text/html")
+			w.WriteHeader(ErrorStatus(err))
+			_, _ = io.WriteString(w, "<h1>Unavailable</h1>")
+		}
+		defer func() {
+			proxy.ErrorHandler = nil
+		}()
+
+		resp, err := http.Get(baseUrl + "/missing/foo")
+		as.Nil(err)
+		as.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+		as.Equal("text/html", resp.Header.Get(headers.ContentType))
+		as.ErrorIs(proxyErr, ErrNoResponders)
+
+		b, err := io.ReadAll(resp.Body)
+		as.Nil(err)
+		as.Equal("<h1>Unavailable</h1>", string(b))
+	})
+
+	t.Run("aborted response", func(t *testing.T) {
+		as := assert.New(t)
+
+		resp, err := http.Get(baseUrl + "/abort")
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+
+		// the client must not mistake the response for a complete one
+		_, err = io.ReadAll(resp.Body)
+		as.NotNil(err)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		as := assert.New(t)
+
+		as.Equal(http.StatusNotFound, ErrorStatus(ErrNoRoute))
+		as.Equal(http.StatusServiceUnavailable, ErrorStatus(ErrNoResponders))
+		as.Equal(http.StatusGatewayTimeout, ErrorStatus(fmt.Errorf("waiting: %w", context.DeadlineExceeded)))
+		as.Equal(http.StatusInternalServerError, ErrorStatus(ErrInvalidRoute))
+		as.Equal(http.StatusBadGateway, ErrorStatus(ErrChunkChecksum))
+	})
+}
+
+// countingListener counts the bytes read from the connections it accepts.
+type countingListener struct {
+	net.Listener
+	count atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, count: &l.count}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	count *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.count.Add(int64(n))
+	return
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestProxy_RequestBodyLimit(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	})
+
+	srv := &Server{
+		Conn:                conn,
+		Subject:             subject,
+		Handler:             routes,
+		MaxRequestBodyBytes: 1 << 20,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	listener := &countingListener{Listener: tcpListener}
+
+	proxy := &Proxy{
+		Subject:   subject,
+		Transport: &Transport{Conn: conn},
+		Listener:  listener,
+	}
+
+	go func() {
+		_ = proxy.Listen(ctx)
+	}()
+
+	size := int64(256 << 20)
+	req, err := http.NewRequest(http.MethodPost, "http://"+tcpListener.Addr().String()+"/upload", io.LimitReader(zeroReader{}, size))
+	assert.Nil(t, err)
+
+	// the client may fail to send the rest of the body once the proxy has closed the connection
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Nil(t, resp.Body.Close())
+	}
+
+	// the proxy stops reading from the client once the server has rejected the body
+	assert.Never(t, func() bool { return listener.count.Load() > size/4 }, time.Second, 10*time.Millisecond)
+}
@@ -2,12 +2,14 @@ package natshttp
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-http-utils/headers"
+	"github.com/juju/errors"
 
 	"github.com/nats-io/nats.go"
 )
@@ -15,6 +17,9 @@ import (
 const (
 	SmallBodySize     = 4 * 1024  // 4 Kb
 	DefaultHeaderSize = 10 * 1024 // 10 Kb
+
+	ErrResponseNotStarted = errors.ConstError("natshttp: response has not been started")
+	ErrResponseClosed     = errors.ConstError("natshttp: response has been closed")
 )
 
 type ResponseWriter struct {
@@ -28,9 +33,28 @@ type ResponseWriter struct {
 
 	chunked       bool
 	contentLength int64
+	written       int64
+	closed        bool
+	hijacked      bool
 
 	flushCount  int
 	flushBuffer []byte
+	checksums   bool
+
+	// flow control
+	ctx    context.Context
+	cancel context.CancelFunc
+	window int
+	acks   *nats.Subscription
+	fc     *flowControl
+
+	// the number of chunks the server is willing to buffer from the client should the connection be hijacked
+	tunnelWindow int
+
+	// compression negotiated with the receiver, and the encoding in use once the body is being compressed
+	compression string
+	encoding    string
+	encoder     compressor
 }
 
 func NewResponseWriter(conn *nats.Conn, subject string) (*ResponseWriter, error) {
@@ -48,9 +72,23 @@ func NewResponseWriter(conn *nats.Conn, subject string) (*ResponseWriter, error)
 		headers:       make(http.Header),
 		buf:           bytes.NewBuffer(nil),
 		contentLength: -1,
+		ctx:           context.Background(),
 	}, nil
 }
 
+// enableFlowControl limits the number of chunks which can be in-flight without being acknowledged by the receiver.
+// Waiting for acknowledgements is bounded by ctx, which is cancelled if the receiver stops consuming the response.
+func (r *ResponseWriter) enableFlowControl(ctx context.Context, cancel context.CancelFunc, window int) {
+	r.ctx = ctx
+	r.cancel = cancel
+	r.window = window
+}
+
+// enableCompression allows the body to be compressed with the given encoding, provided it is worth compressing.
+func (r *ResponseWriter) enableCompression(encoding string) {
+	r.compression = encoding
+}
+
 func (r *ResponseWriter) Header() http.Header {
 	return r.headers
 }
@@ -62,23 +100,15 @@ func (r *ResponseWriter) WriteHeader(statusCode int) {
 
 	h := r.headers
 
+	// trailers can only be sent at the end of a chunk stream
+	if h.Get(headerTrailer) != "" {
+		h.Set(headers.TransferEncoding, "chunked")
+	}
+
 	// set status code and message
 	h.Set(HeaderStatus, http.StatusText(statusCode))
 	h.Set(HeaderStatusCode, strconv.FormatInt(int64(statusCode), 10))
 
-	// attempt to determine content length
-	if r.flushCount == 0 && h.Get(headers.ContentLength) == "" {
-		buffered := r.buf.Len()
-
-		// if the total size of all written data is under a few KB and there are no flush calls, the
-		// Content-Length header is added automatically, otherwise we assume a chunked transfer
-		if buffered > 0 && buffered <= SmallBodySize {
-			h.Set(headers.ContentLength, strconv.Itoa(buffered))
-		} else if buffered > SmallBodySize {
-			h.Set(headers.TransferEncoding, "chunked")
-		}
-	}
-
 	if h.Get(headers.TransferEncoding) == "chunked" {
 		// transfer encoding takes precedence, remove content length if present
 		h.Del(headers.ContentLength)
@@ -103,10 +133,65 @@ func (r *ResponseWriter) WriteHeader(statusCode int) {
 	r.chunked = (totalBytes > r.maxMsgSize) || h.Get(headers.TransferEncoding) == "chunked"
 
 	r.headersWritten = true
+
+	// bodies which are small or already encoded are not worth compressing
+	if h.Get(headers.ContentEncoding) != "" || (r.contentLength >= 0 && r.contentLength < minCompressionSize) {
+		r.compression = ""
+	}
+}
+
+// startCompression routes the body through an encoder, compressing anything which has already been buffered.
+func (r *ResponseWriter) startCompression() {
+	buf := bytes.NewBuffer(nil)
+
+	encoder, err := newCompressor(r.compression, buf)
+	if err != nil {
+		// fall back to sending the body uncompressed
+		r.compression = ""
+		return
+	}
+
+	if _, err = encoder.Write(r.buf.Bytes()); err != nil {
+		r.compression = ""
+		return
+	}
+
+	r.buf = buf
+	r.encoding = r.compression
+	r.encoder = encoder
+}
+
+// closeEncoder writes any remaining compressed data to the buffer.
+func (r *ResponseWriter) closeEncoder() error {
+	if r.encoder == nil {
+		return nil
+	}
+	err := r.encoder.Close()
+	r.encoder = nil
+	return err
 }
 
 func (r *ResponseWriter) Write(b []byte) (n int, err error) {
-	n, err = r.buf.Write(b)
+	if r.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if r.closed {
+		return 0, ErrResponseClosed
+	}
+
+	// the request has been cancelled or has expired
+	if err = r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if r.encoder != nil {
+		n, err = r.encoder.Write(b)
+	} else {
+		n, err = r.buf.Write(b)
+	}
+
+	r.written += int64(n)
+
 	if err != nil {
 		return
 	}
@@ -120,14 +205,113 @@ func (r *ResponseWriter) Write(b []byte) (n int, err error) {
 		}
 	}
 
+	// the body is compressed once enough has been written for it to be worthwhile, provided nothing has been sent
+	if r.encoder == nil && r.compression != "" && r.flushCount == 0 && r.buf.Len() >= minCompressionSize {
+		r.startCompression()
+	}
+
 	if r.buf.Len() >= r.maxMsgSize {
-		err = r.flush()
+		err = r.flush(false)
 	}
 
 	return
 }
 
-func (r *ResponseWriter) flush() (err error) {
+// Flush implements http.Flusher.
+func (r *ResponseWriter) Flush() {
+	_ = r.FlushError()
+}
+
+// FlushError publishes any buffered data immediately, switching the response to a chunk stream if it has not been
+// started yet. It is used by http.ResponseController.
+func (r *ResponseWriter) FlushError() error {
+	if r.hijacked {
+		return http.ErrHijacked
+	}
+	if r.closed {
+		return ErrResponseClosed
+	}
+
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+
+	if !r.headersWritten {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	if r.encoder != nil {
+		if err := r.encoder.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// the headers are sent even if nothing has been written
+	if r.flushCount == 0 && r.buf.Len() == 0 {
+		return r.publishHeaders()
+	}
+
+	return r.flush(false)
+}
+
+// startResponse determines how the response is framed before its first msg is published, with final indicating
+// that the entire body has been written. Once the first msg has been published neither the framing nor the
+// compression of the body can change.
+func (r *ResponseWriter) startResponse(final bool) error {
+	if !r.chunked {
+		switch {
+		case !final:
+			// more of the body will follow
+			r.startChunked()
+		case r.contentLength < 0 && r.written > 0 && r.written <= SmallBodySize:
+			// if the total size of all written data is under a few KB and there are no flush calls, the
+			// Content-Length header is added automatically
+			r.headers.Set(headers.ContentLength, strconv.FormatInt(r.written, 10))
+			r.contentLength = r.written
+		case r.contentLength < 0 && r.written > SmallBodySize:
+			r.startChunked()
+		}
+	}
+
+	if r.encoding == "" {
+		r.compression = ""
+	}
+
+	// subsequent chunks are subject to flow control
+	if r.chunked && r.window > 0 && r.acks == nil {
+		return r.subscribeAcks()
+	}
+
+	return nil
+}
+
+func (r *ResponseWriter) startChunked() {
+	r.headers.Set(headers.TransferEncoding, "chunked")
+	r.headers.Del(headers.ContentLength)
+	r.contentLength = -1
+	r.chunked = true
+}
+
+// publishHeaders sends the first msg of a chunk stream without any data.
+func (r *ResponseWriter) publishHeaders() error {
+	if err := r.startResponse(false); err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(r.subject)
+	msg.Header = r.msgHeader()
+	reserveChunkHeaders(msg, 0, r.checksums)
+	sealChunk(msg)
+
+	if err := r.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	r.flushCount += 1
+	return nil
+}
+
+func (r *ResponseWriter) flush(final bool) (err error) {
 	// initialise the byte arrays used for reading from the write buffer
 	if r.flushBuffer == nil {
 		r.flushBuffer = make([]byte, r.maxMsgSize)
@@ -140,7 +324,18 @@ func (r *ResponseWriter) flush() (err error) {
 
 		// add headers to first msg
 		if r.flushCount == 0 {
-			msg.Header = nats.Header(r.headers)
+			if r.buf.Len() == 0 {
+				return nil
+			}
+			if err = r.startResponse(final); err != nil {
+				return err
+			}
+			msg.Header = r.msgHeader()
+		}
+
+		// sequence and checksum headers must be accounted for when sizing the data field
+		if r.chunked {
+			reserveChunkHeaders(msg, r.flushCount, r.checksums)
 		}
 
 		// determine max size of the data field
@@ -171,6 +366,16 @@ func (r *ResponseWriter) flush() (err error) {
 			return errors.New("natshttp: failed to copy all bytes into msg.Data")
 		}
 
+		sealChunk(msg)
+
+		if err = r.ctx.Err(); err != nil {
+			return err
+		}
+
+		if err = r.acquire(); err != nil {
+			return err
+		}
+
 		if err = r.conn.PublishMsg(msg); err != nil {
 			return err
 		}
@@ -179,9 +384,114 @@ func (r *ResponseWriter) flush() (err error) {
 	}
 }
 
+// msgHeader returns the headers for the first msg of the response, excluding trailers which are set using
+// http.TrailerPrefix.
+func (r *ResponseWriter) msgHeader() nats.Header {
+	h := make(nats.Header, len(r.headers))
+	for key, values := range r.headers {
+		if !strings.HasPrefix(key, http.TrailerPrefix) {
+			h[key] = values
+		}
+	}
+	if r.encoding != "" {
+		h.Set(HeaderCompression, r.encoding)
+	}
+	return h
+}
+
+// trailer collects the values of any keys declared in the Trailer header, as well as any keys set using
+// http.TrailerPrefix.
+func (r *ResponseWriter) trailer() http.Header {
+	trailer := declaredTrailer(r.headers)
+	for key := range trailer {
+		trailer[key] = r.headers[key]
+	}
+
+	for key, values := range r.headers {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			trailer[http.CanonicalHeaderKey(key[len(http.TrailerPrefix):])] = values
+		}
+	}
+
+	return trailer
+}
+
+func (r *ResponseWriter) subscribeAcks() (err error) {
+	inbox := r.conn.NewInbox()
+	if r.acks, err = r.conn.SubscribeSync(inbox); err != nil {
+		return err
+	}
+	r.fc = newFlowControl(r.window, r.acks)
+	r.headers.Set(HeaderChunkAckSubject, inbox)
+	return nil
+}
+
+// acquire waits for credit before publishing any chunk after the first.
+func (r *ResponseWriter) acquire() error {
+	if r.fc == nil || r.flushCount == 0 {
+		return nil
+	}
+	err := r.fc.acquire(r.ctx)
+	if errors.Is(err, ErrReceiverClosed) && r.cancel != nil {
+		r.cancel()
+	}
+	return err
+}
+
+// Abort terminates a response which is being streamed, informing the receiver of the reason. It returns
+// ErrResponseNotStarted if nothing has been sent yet, in which case the caller is free to send an error response
+// instead.
+func (r *ResponseWriter) Abort(reason error) error {
+	if r.closed {
+		return nil
+	}
+
+	if r.flushCount == 0 {
+		return ErrResponseNotStarted
+	}
+
+	r.closed = true
+	r.release()
+
+	if !r.chunked {
+		// the response was sent as a single msg and is already complete
+		return nil
+	}
+
+	return r.conn.PublishMsg(newAbortMsg(r.subject, reason))
+}
+
+func (r *ResponseWriter) release() {
+	_ = r.closeEncoder()
+	if r.acks != nil {
+		_ = r.acks.Unsubscribe()
+	}
+}
+
 func (r *ResponseWriter) Close() error {
-	// flush any pending chunks
-	if err := r.flush(); err != nil {
+	if r.closed {
+		return nil
+	}
+
+	if err := r.close(); err != nil {
+		// the receiver must be informed that the response will not complete
+		if r.chunked && r.flushCount > 0 {
+			_ = r.conn.PublishMsg(newAbortMsg(r.subject, err))
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (r *ResponseWriter) close() error {
+	r.closed = true
+	defer r.release()
+
+	if err := r.closeEncoder(); err != nil {
 		return err
 	}
 
@@ -190,17 +500,34 @@ func (r *ResponseWriter) Close() error {
 		r.WriteHeader(http.StatusOK)
 	}
 
+	// flush any pending chunks
+	if err := r.flush(true); err != nil {
+		return err
+	}
+
 	// if no msgs have been sent yet, we generate and send a single message with the headers
 	// this happens in the case of HEAD responses for example
-	if r.flushCount == 0 {
+	if r.flushCount == 0 && !r.chunked {
 		msg := nats.NewMsg(r.subject)
-		msg.Header = nats.Header(r.headers)
+		msg.Header = r.msgHeader()
 		return r.conn.PublishMsg(msg)
 	}
 
+	// a chunk stream without a body, for example one which only carries trailers
+	if r.flushCount == 0 {
+		if err := r.publishHeaders(); err != nil {
+			return err
+		}
+	}
+
 	if r.chunked {
 		// send empty message to indicate end of chunk stream
+		if err := r.acquire(); err != nil {
+			return err
+		}
 		msg := nats.NewMsg(r.subject)
+		setTrailerHeaders(msg, r.trailer())
+		reserveChunkHeaders(msg, r.flushCount, false)
 		return r.conn.PublishMsg(msg)
 	}
 
@@ -184,3 +184,80 @@ func TestResponseWriter_WriteLargeBodyWithContentLength(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, body, data)
 }
+
+func TestResponseWriter_WriteMultipleSmallWrites(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	subject := strings.ReplaceAll(t.Name(), "_", ".")
+
+	msgs := make(chan *nats.Msg, 1)
+	_, err := conn.ChanSubscribe(subject, msgs)
+	assert.Nil(t, err)
+
+	w, err := NewResponseWriter(conn, subject)
+	assert.Nil(t, err)
+
+	// the content length is determined from all writes, not just the first
+	for i := 0; i < 4; i++ {
+		_, err = w.Write([]byte("hello world"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+
+	msg := <-msgs
+	assert.Equal(t, "44", msg.Header.Get("Content-Length"))
+	assert.Empty(t, msg.Header.Get("Transfer-Encoding"))
+	assert.Equal(t, strings.Repeat("hello world", 4), string(msg.Data))
+}
+
+func TestResponseWriter_Flush(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	subject := strings.ReplaceAll(t.Name(), "_", ".")
+
+	msgs := make(chan *nats.Msg, 4)
+	_, err := conn.ChanSubscribe(subject, msgs)
+	assert.Nil(t, err)
+
+	w, err := NewResponseWriter(conn, subject)
+	assert.Nil(t, err)
+
+	var _ http.Flusher = w
+	rc := http.NewResponseController(w)
+
+	// flushing before anything is written sends the headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	assert.Nil(t, rc.Flush())
+
+	msg := <-msgs
+	assert.Equal(t, "chunked", msg.Header.Get("Transfer-Encoding"))
+	assert.Empty(t, msg.Header.Get("Content-Length"))
+	assert.Equal(t, "text/event-stream", msg.Header.Get("Content-Type"))
+	assert.Equal(t, "0", msg.Header.Get(HeaderChunkSeq))
+	assert.Empty(t, msg.Data)
+
+	// each flush publishes the buffered data immediately
+	for _, event := range []string{"data: foo\n\n", "data: bar\n\n"} {
+		_, err = w.Write([]byte(event))
+		assert.Nil(t, err)
+		w.Flush()
+
+		msg = <-msgs
+		assert.Equal(t, event, string(msg.Data))
+	}
+
+	// flushing with nothing buffered is a no-op
+	assert.Nil(t, rc.Flush())
+
+	assert.Nil(t, w.Close())
+
+	// terminator
+	msg = <-msgs
+	assert.Empty(t, msg.Data)
+
+	assert.ErrorIs(t, rc.Flush(), ErrResponseClosed)
+}
@@ -0,0 +1,181 @@
+package natshttp
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	DefaultRetryMaxAttempts    = 3
+	DefaultRetryInitialBackoff = 100 * time.Millisecond
+	DefaultRetryMaxBackoff     = 2 * time.Second
+	DefaultRetryMultiplier     = 2.0
+	DefaultRetryJitter         = 0.2
+)
+
+// DefaultRetryMethods are the idempotent http methods which are retried unless RetryPolicy.Methods says otherwise.
+var DefaultRetryMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// RetryPolicy controls how a Transport retries requests which fail for transient reasons, such as there being no
+// responders during a rolling deploy. Zero values are replaced with the corresponding defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, which is multiplied by Multiplier for each subsequent
+	// retry up to a maximum of MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction, between 0 and 1, by which each backoff is randomly reduced.
+	Jitter float64
+
+	// AttemptTimeout bounds each individual attempt. Attempts which exceed it are retried, provided the overall
+	// request context has not expired.
+	AttemptTimeout time.Duration
+
+	// Methods which may be retried, defaults to DefaultRetryMethods.
+	Methods []string
+
+	// Retryable decides if an error is transient. By default ErrNoResponders and attempt timeouts are retried.
+	Retryable func(err error) bool
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) allowsMethod(method string) bool {
+	methods := p.Methods
+	if methods == nil {
+		methods = DefaultRetryMethods
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) retryable(ctx context.Context, err error) bool {
+	// the request itself has been cancelled or has expired
+	if ctx.Err() != nil {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return errors.Is(err, ErrNoResponders) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// backoff returns the delay before the given retry, where retry 1 is the first retry.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	initial := p.InitialBackoff
+	if initial == 0 {
+		initial = DefaultRetryInitialBackoff
+	}
+
+	max := p.MaxBackoff
+	if max == 0 {
+		max = DefaultRetryMaxBackoff
+	}
+
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = DefaultRetryMultiplier
+	}
+
+	jitter := p.Jitter
+	if jitter == 0 {
+		jitter = DefaultRetryJitter
+	}
+
+	backoff := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	if backoff > float64(max) {
+		backoff = float64(max)
+	}
+
+	backoff -= backoff * jitter * rand.Float64()
+
+	return time.Duration(backoff)
+}
+
+func (p *RetryPolicy) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.AttemptTimeout > 0 {
+		return context.WithTimeout(ctx, p.AttemptTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// do invokes roundTrip until it succeeds, returns a non-retryable error or the attempts have been exhausted.
+// Request bodies are replayed using http.Request.GetBody, requests with a body which cannot be replayed are only
+// attempted once.
+func (p *RetryPolicy) do(
+	req *http.Request,
+	roundTrip func(*http.Request) (*http.Response, error),
+) (resp *http.Response, err error) {
+	ctx := req.Context()
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	attempts := p.maxAttempts()
+
+	if !p.allowsMethod(req.Method) || (hasBody && req.GetBody == nil) {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+
+		if attempt > 1 && hasBody {
+			// the previous attempt will have consumed and closed the body
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, errors.Annotate(bodyErr, "natshttp: failed to replay request body")
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		attemptCtx, cancel := p.attemptContext(ctx)
+
+		resp, err = roundTrip(attemptReq.WithContext(attemptCtx))
+		if err == nil {
+			if _, tunnel := resp.Body.(*tunnelConn); tunnel {
+				// the tunnel outlives the attempt and must remain writable
+				cancel()
+			} else {
+				resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			}
+			return resp, nil
+		}
+
+		cancel()
+
+		if attempt >= attempts || !p.retryable(ctx, err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.backoff(attempt)):
+		}
+	}
+}
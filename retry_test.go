@@ -0,0 +1,94 @@
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		backoff := policy.backoff(retry + 1)
+		assert.LessOrEqual(t, backoff, max)
+		assert.GreaterOrEqual(t, backoff, max/2)
+	}
+}
+
+func TestTransport_Retry(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Put("/echo", func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(w, r.Body)
+		assert.Nil(t, err)
+	})
+
+	transport := &Transport{
+		Conn: conn,
+		Retry: &RetryPolicy{
+			MaxAttempts:    10,
+			InitialBackoff: 50 * time.Millisecond,
+			MaxBackoff:     100 * time.Millisecond,
+		},
+	}
+
+	t.Run("non-idempotent", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "nats+http://"+subject+"/echo", bytes.NewReader([]byte("hello world")))
+		assert.Nil(t, err)
+
+		start := time.Now()
+		_, err = transport.RoundTrip(req)
+		assert.ErrorIs(t, err, ErrNoResponders)
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		srv := &Server{
+			Conn:    conn,
+			Subject: subject,
+			Handler: routes,
+		}
+
+		// the first attempts will fail as there are no responders
+		go func() {
+			<-time.After(200 * time.Millisecond)
+			_ = srv.Listen(ctx)
+		}()
+
+		body := make([]byte, conn.MaxPayload()*3)
+		_, err := rand.Read(body)
+		assert.Nil(t, err)
+
+		req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/echo", bytes.NewReader(body))
+		assert.Nil(t, err)
+
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, b)
+		assert.Nil(t, resp.Body.Close())
+	})
+}
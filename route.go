@@ -0,0 +1,101 @@
+package natshttp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+const (
+	ErrNoRoute      = errors.ConstError("natshttp: no route for request")
+	ErrInvalidRoute = errors.ConstError("natshttp: invalid route")
+)
+
+// Route forwards requests received by a Proxy which match Host and PathPrefix to Subject.
+type Route struct {
+	// Host is matched against the Host header of a request, ignoring case and any port. An empty Host matches any
+	// host.
+	Host string
+	// PathPrefix is matched against the path of a request on segment boundaries, so that /api matches /api and
+	// /api/users but not /apis. An empty PathPrefix matches any path.
+	PathPrefix string
+	// StripPrefix removes PathPrefix from the path before the request is forwarded.
+	StripPrefix bool
+	// Subject is the prefix of the subject hierarchy the request is forwarded to.
+	Subject string
+}
+
+// routingTable selects the route for a request. Routes are ordered so that routes for a specific host take
+// precedence over those for any host, and within each of those the first match is the one with the longest path
+// prefix.
+type routingTable struct {
+	routes []Route
+}
+
+func newRoutingTable(routes []Route, defaultSubject string) (*routingTable, error) {
+	table := &routingTable{}
+
+	for _, route := range routes {
+		if route.Subject == "" {
+			return nil, fmt.Errorf("%w: host '%s' and path prefix '%s' has no subject", ErrInvalidRoute, route.Host, route.PathPrefix)
+		}
+		route.Host = strings.ToLower(route.Host)
+		route.PathPrefix = strings.TrimSuffix(route.PathPrefix, "/")
+		table.routes = append(table.routes, route)
+	}
+
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		a, b := table.routes[i], table.routes[j]
+		if (a.Host != "") != (b.Host != "") {
+			return a.Host != ""
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+
+	// the default route matches anything which isn't matched by a more specific route
+	if defaultSubject != "" {
+		table.routes = append(table.routes, Route{Subject: defaultSubject})
+	}
+
+	return table, nil
+}
+
+// match returns the subject and path a request for host and path should be forwarded to.
+func (t *routingTable) match(host string, path string) (subject string, forwardPath string, err error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, route := range t.routes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if !hasPathPrefix(path, route.PathPrefix) {
+			continue
+		}
+
+		forwardPath = path
+		if route.StripPrefix {
+			forwardPath = strings.TrimPrefix(path, route.PathPrefix)
+			if !strings.HasPrefix(forwardPath, "/") {
+				forwardPath = "/" + forwardPath
+			}
+		}
+
+		return route.Subject, forwardPath, nil
+	}
+
+	return "", "", ErrNoRoute
+}
+
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	rest := path[len(prefix):]
+	return rest == "" || rest[0] == '/'
+}
@@ -0,0 +1,140 @@
+package natshttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingTable(t *testing.T) {
+	as := assert.New(t)
+
+	_, err := newRoutingTable([]Route{{PathPrefix: "/api"}}, "")
+	as.EqualError(err, "natshttp: invalid route: host '' and path prefix '/api' has no subject")
+	as.ErrorIs(err, ErrInvalidRoute)
+
+	table, err := newRoutingTable([]Route{
+		{PathPrefix: "/api", Subject: "api"},
+		{PathPrefix: "/api/users/", StripPrefix: true, Subject: "users"},
+		{Host: "Admin.Example.com", PathPrefix: "/api", Subject: "admin.api"},
+		{Host: "admin.example.com", Subject: "admin"},
+	}, "default")
+	as.Nil(err)
+
+	for _, tc := range []struct {
+		host    string
+		path    string
+		subject string
+		forward string
+	}{
+		{"example.com", "/", "default", "/"},
+		{"example.com", "/apis", "default", "/apis"},
+		{"example.com", "/api", "api", "/api"},
+		{"example.com", "/api/orders", "api", "/api/orders"},
+		{"example.com", "/api/users", "users", "/"},
+		{"example.com:8080", "/api/users/123", "users", "/123"},
+		{"admin.example.com", "/", "admin", "/"},
+		{"ADMIN.example.com:8080", "/api/orders", "admin.api", "/api/orders"},
+		// the host takes precedence over the longest path prefix
+		{"admin.example.com", "/api/users/123", "admin.api", "/api/users/123"},
+	} {
+		subject, forward, err := table.match(tc.host, tc.path)
+		as.Nil(err)
+		as.Equal(tc.subject, subject, "%s%s", tc.host, tc.path)
+		as.Equal(tc.forward, forward, "%s%s", tc.host, tc.path)
+	}
+
+	// without a default route
+	table, err = newRoutingTable([]Route{{PathPrefix: "/api", Subject: "api"}}, "")
+	as.Nil(err)
+
+	_, _, err = table.match("example.com", "/")
+	as.ErrorIs(err, ErrNoRoute)
+}
+
+func TestProxy_Routes(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+" "+r.URL.Path)
+		})
+	}
+
+	srv := &Server{
+		Conn:    conn,
+		Subject: subject,
+		Handler: handler("default"),
+		Hosts: map[string]http.Handler{
+			"svc.users":  handler("users"),
+			"svc.orders": handler("orders"),
+		},
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	proxy := &Proxy{
+		Transport: &Transport{Conn: conn},
+		Listener:  listener,
+		Routes: []Route{
+			{PathPrefix: "/users", StripPrefix: true, Subject: "svc.users"},
+		},
+	}
+
+	go func() {
+		_ = proxy.Listen(ctx)
+	}()
+
+	baseUrl := fmt.Sprintf("http://%s", listener.Addr())
+
+	get := func(t *testing.T, path string, code int, body string) {
+		resp, err := http.Get(baseUrl + path)
+		assert.Nil(t, err)
+		assert.Equal(t, code, resp.StatusCode)
+
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(b))
+	}
+
+	t.Run("initial", func(t *testing.T) {
+		get(t, "/users/123", http.StatusOK, "users /123")
+		get(t, "/orders/456", http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		assert.NotNil(t, proxy.SetRoutes([]Route{{PathPrefix: "/orders"}}))
+
+		assert.Nil(t, proxy.SetRoutes([]Route{
+			{PathPrefix: "/orders", Subject: "svc.orders"},
+			{Host: "localhost", Subject: "svc.users"},
+			{Subject: subject},
+		}))
+
+		get(t, "/users/123", http.StatusOK, "default /users/123")
+		get(t, "/orders/456", http.StatusOK, "orders /orders/456")
+
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/", listener.Addr().(*net.TCPAddr).Port))
+		assert.Nil(t, err)
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, "users /", string(b))
+	})
+}
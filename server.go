@@ -3,9 +3,16 @@ package natshttp
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
 
@@ -14,6 +21,18 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
+const (
+	ErrServerClosed    = errors.ConstError("natshttp: Server closed")
+	ErrServerSaturated = errors.ConstError("natshttp: Server is saturated, request rejected")
+	ErrHandlerPanic    = errors.ConstError("natshttp: handler panic")
+
+	ErrRequestBodyTooLarge   = errors.ConstError("natshttp: request body too large")
+	ErrRequestHeaderTooLarge = errors.ConstError("natshttp: request header fields too large")
+
+	// DefaultRetryAfter is advertised to clients whose requests are rejected because the server is saturated.
+	DefaultRetryAfter = time.Second
+)
+
 var NoOpErrorHandler = func(_ error) {
 }
 
@@ -25,11 +44,68 @@ type Server struct {
 	Handler      http.Handler
 	ErrorHandler func(error)
 
+	// Hosts maps additional subject prefixes to the handler for requests received on them, allowing a single Server
+	// to serve several virtual hosts. Requests for Subject are handled by Handler, which can be omitted if Hosts is
+	// set. Prefixes cannot overlap, and all hosts share the same limits on concurrency.
+	Hosts map[string]http.Handler
+
 	PendingMsgsLimit  int
 	PendingBytesLimit int
 
-	sub        *nats.Subscription
+	// ChunkWindow is the maximum number of request body chunks a client may send before they have been acknowledged,
+	// and is announced to clients during the chunk handshake. Defaults to DefaultChunkWindow, a negative value
+	// disables flow control.
+	ChunkWindow int
+
+	// ChunkChecksums adds a checksum to each chunk of a chunked response body, allowing the client to detect
+	// corruption.
+	ChunkChecksums bool
+
+	// Compression lists the encodings which may be used for compressing bodies on the wire, in order of preference.
+	// An encoding is only used for a response body if the client has announced support for it, and the encodings are
+	// announced to clients during the chunk handshake so that they can compress the remainder of a request body.
+	// Defaults to no compression.
+	Compression []string
+
+	// MaxConcurrentRequests limits the number of requests which are handled at the same time. Requests which arrive
+	// when the limit has been reached wait in a queue of up to MaxQueuedRequests, beyond which they are rejected with
+	// a 503 Service Unavailable. Defaults to no limit.
+	MaxConcurrentRequests int
+	MaxQueuedRequests     int
+
+	// RetryAfter is sent to clients whose requests are rejected because the server is saturated. Defaults to
+	// DefaultRetryAfter.
+	RetryAfter time.Duration
+
+	// MaxRequestBodyBytes limits the size of request bodies. Requests which declare a larger Content-Length are
+	// rejected with a 413 Request Entity Too Large, whilst reading a chunked body fails with an *http.MaxBytesError
+	// once the limit is crossed, at which point the client is told to stop sending. Compressed bodies are limited by
+	// their size after decompression. If the handler does not respond to the error, a 413 is sent on its behalf.
+	// Defaults to no limit.
+	MaxRequestBodyBytes int64
+
+	// TrustClientInfo populates the RemoteAddr of requests with the IP announced by the client, see ClientInfo. The
+	// announcement can be forged by any NATS publisher, so this should only be enabled if all of them are trusted.
+	// Otherwise RemoteAddr is left empty, and a Gateway replaces any forwarded headers sent with the request.
+	TrustClientInfo bool
+
+	// MaxHeaderBytes limits the size of the subject and headers of a request, beyond which it is rejected with a 431
+	// Request Header Fields Too Large. Defaults to no limit.
+	MaxHeaderBytes int
+
+	hosts      []virtualHost
+	subs       []*nats.Subscription
+	cancels    *cancelMux
 	maxMsgSize int
+
+	mu         sync.Mutex
+	inShutdown bool
+	listenDone chan struct{}
+	inFlight   sync.WaitGroup
+
+	// parent of all request contexts, cancelled to force the termination of in-flight requests
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (s *Server) Listen(ctx context.Context) error {
@@ -37,14 +113,23 @@ func (s *Server) Listen(ctx context.Context) error {
 		return errors.New("natshttp: Server.Conn cannot be nil")
 	}
 
-	if s.Subject == "" {
+	if s.Subject == "" && len(s.Hosts) == 0 {
 		return errors.New("natshttp: Server.Subject cannot be empty")
 	}
 
-	if s.Handler == nil {
+	if s.Subject != "" && s.Handler == nil {
 		return errors.New("natshttp: Server.Handler cannot be nil")
 	}
 
+	hosts, err := s.virtualHosts()
+	if err != nil {
+		return err
+	}
+
+	if err := validateCompression(s.Compression); err != nil {
+		return err
+	}
+
 	if s.ErrorHandler == nil {
 		s.ErrorHandler = NoOpErrorHandler
 	}
@@ -58,72 +143,459 @@ func (s *Server) Listen(ctx context.Context) error {
 		s.PendingBytesLimit = 1024 * 1024 * 1024
 	}
 
-	var err error
-	var sub *nats.Subscription
+	if s.RetryAfter == 0 {
+		s.RetryAfter = DefaultRetryAfter
+	}
 
-	if s.Group == "" {
-		sub, err = s.Conn.SubscribeSync(s.Subject + ".>")
-	} else {
-		sub, err = s.Conn.QueueSubscribeSync(s.Subject+".>", s.Group)
+	if s.maxMsgSize == 0 {
+		s.maxMsgSize = int(s.Conn.MaxPayload())
 	}
 
-	// set pending limits on the subscription to prevent slow consumer detection in high load scenarios
-	if err = sub.SetPendingLimits(s.PendingMsgsLimit, s.PendingBytesLimit); err != nil {
-		return err
+	s.mu.Lock()
+
+	if s.inShutdown {
+		s.mu.Unlock()
+		return ErrServerClosed
 	}
 
+	var subs []*nats.Subscription
+	for _, host := range hosts {
+		sub, err := s.subscribe(host.prefix)
+		if err != nil {
+			for _, sub := range subs {
+				_ = sub.Unsubscribe()
+			}
+			s.mu.Unlock()
+			return err
+		}
+		subs = append(subs, sub)
+	}
+
+	cancels, err := newCancelMux(s.Conn)
 	if err != nil {
+		for _, sub := range subs {
+			_ = sub.Unsubscribe()
+		}
+		s.mu.Unlock()
 		return err
 	}
 
-	if s.maxMsgSize == 0 {
-		s.maxMsgSize = int(s.Conn.MaxPayload())
+	done := make(chan struct{})
+
+	s.hosts = hosts
+	s.subs = subs
+	s.cancels = cancels
+	s.listenDone = done
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.mu.Unlock()
+
+	// with a limit on concurrency, requests are handed to a fixed number of workers via a bounded queue
+	var queue chan *nats.Msg
+	if s.MaxConcurrentRequests > 0 {
+		queue = make(chan *nats.Msg, s.MaxQueuedRequests)
+		for i := 0; i < s.MaxConcurrentRequests; i++ {
+			go s.worker(queue)
+		}
+	}
+
+	// requests from every subscription are received in a single loop
+	msgs := make(chan *nats.Msg)
+	errs := make(chan error, len(subs))
+	stop := make(chan struct{})
+
+	for _, sub := range subs {
+		go receive(ctx, sub, msgs, errs, stop)
+	}
+
+	defer func() {
+		close(stop)
+		// stop receiving requests, this has no effect if the subscriptions have been drained
+		for _, sub := range subs {
+			_ = sub.Unsubscribe()
+		}
+		if queue != nil {
+			// workers exit once any queued requests have been handled
+			close(queue)
+		}
+		// requests which are still being handled can be cancelled until they complete
+		go func() {
+			s.inFlight.Wait()
+			_ = cancels.Close()
+		}()
+		close(done)
+	}()
+
+	for remaining := len(subs); remaining > 0; {
+		var msg *nats.Msg
+
+		select {
+		case msg = <-msgs:
+		case err := <-errs:
+			if !s.shuttingDown() {
+				return err
+			}
+			// whilst shutting down, requests already delivered to the other subscriptions must still be handled
+			remaining -= 1
+			continue
+		}
+
+		s.inFlight.Add(1)
+
+		if queue == nil {
+			go func() {
+				defer s.inFlight.Done()
+				s.handle(msg)
+			}()
+			continue
+		}
+
+		select {
+		case queue <- msg:
+		default:
+			// all workers are busy and the queue is full
+			s.inFlight.Done()
+			s.ErrorHandler(ErrServerSaturated)
+			if err = s.reject(msg); err != nil {
+				s.ErrorHandler(err)
+			}
+		}
 	}
 
+	return ErrServerClosed
+}
+
+// receive forwards the msgs of sub to msgs until it fails, for example because it has been drained.
+func receive(ctx context.Context, sub *nats.Subscription, msgs chan<- *nats.Msg, errs chan<- error, stop <-chan struct{}) {
 	for {
 		msg, err := sub.NextMsgWithContext(ctx)
 		if err != nil {
-			return err
+			errs <- err
+			return
 		}
+		select {
+		case msgs <- msg:
+		case <-stop:
+			return
+		}
+	}
+}
 
-		go func() {
-			if err := s.onMsg(msg); err != nil {
-				s.ErrorHandler(err)
-			}
-		}()
+func (s *Server) worker(queue <-chan *nats.Msg) {
+	for msg := range queue {
+		s.handle(msg)
+		s.inFlight.Done()
+	}
+}
+
+func (s *Server) handle(msg *nats.Msg) {
+	if err := s.onMsg(msg); err != nil {
+		s.ErrorHandler(err)
 	}
 }
 
-func (s *Server) onMsg(msg *nats.Msg) error {
-	req := http.Request{}
+// reject informs the client that the server is saturated, rather than leaving the request to time out.
+func (s *Server) reject(msg *nats.Msg) error {
+	writer, err := NewResponseWriter(s.Conn, msg.Reply)
+	if err != nil {
+		return err
+	}
 
-	if err := s.msgToHttpRequest(msg, &req); err != nil {
+	retryAfter := int64(math.Ceil(s.RetryAfter.Seconds()))
+
+	writer.Header().Set(headers.RetryAfter, strconv.FormatInt(retryAfter, 10))
+	writer.Header().Set(headers.ContentType, "text/plain; charset=utf-8")
+	writer.WriteHeader(http.StatusServiceUnavailable)
+
+	if _, err = io.WriteString(writer, ErrServerSaturated.Error()); err != nil {
 		return err
 	}
 
+	return writer.Close()
+}
+
+func (s *Server) subscribe(prefix string) (sub *nats.Subscription, err error) {
+	if s.Group == "" {
+		sub, err = s.Conn.SubscribeSync(prefix + ".>")
+	} else {
+		sub, err = s.Conn.QueueSubscribeSync(prefix+".>", s.Group)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// set pending limits on the subscription to prevent slow consumer detection in high load scenarios
+	if err = sub.SetPendingLimits(s.PendingMsgsLimit, s.PendingBytesLimit); err != nil {
+		_ = sub.Unsubscribe()
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// Shutdown gracefully shuts down the server. The subscription is drained so that no new requests are accepted, and
+// Shutdown waits for in-flight requests to finish, including any chunked uploads and responses. If ctx expires first,
+// in-flight requests are cancelled and the context's error is returned. Once Shutdown has been called, Listen returns
+// ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	subs, listenDone, cancel := s.subs, s.listenDone, s.cancel
+	s.mu.Unlock()
+
+	// requests which have already been delivered to the subscriptions are still handled
+	for _, sub := range subs {
+		if err := sub.Drain(); err != nil && !errors.Is(err, nats.ErrBadSubscription) {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		if listenDone != nil {
+			<-listenDone
+		}
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if cancel != nil {
+			cancel()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *Server) onMsg(msg *nats.Msg) (err error) {
+	ctx, cancel, err := requestContext(s.ctx, msg)
+	if err != nil {
+		return s.replyError(msg, badRequest(err))
+	}
+	defer cancel()
+
+	ctx = s.requestValues(ctx, msg)
+
+	// the client may cancel the request, for example if it is no longer waiting for the response
+	release, err := s.subscribeCancel(msg, cancel)
+	if err != nil {
+		return s.replyError(msg, badRequest(err))
+	}
+	defer release()
+
+	// the client announces how many response chunks it is willing to buffer
+	window, err := parseChunkWindow(msg)
+	if err != nil {
+		return s.replyError(msg, badRequest(err))
+	}
+
+	host, ok := s.host(msg.Subject)
+	if !ok {
+		return s.replyError(msg, badRequest(errors.Errorf("natshttp: no host for subject '%s'", msg.Subject)))
+	}
+
+	req := (&http.Request{}).WithContext(ctx)
+
+	if err := s.msgToHttpRequest(host.prefix, msg, req); err != nil {
+		return s.replyError(msg, err)
+	}
+
+	// the port of the client is not known
+	if info, ok := ClientInfoFromContext(ctx); ok && info.IP != nil && s.TrustClientInfo {
+		req.RemoteAddr = net.JoinHostPort(info.IP.String(), "0")
+	}
+
 	writer, err := NewResponseWriter(s.Conn, msg.Reply)
 	if err != nil {
+		_ = req.Body.Close()
 		return err
 	}
 
-	s.Handler.ServeHTTP(writer, &req)
+	if body, ok := req.Body.(*continueReader); ok {
+		// once the response has started it takes the place of the chunk handshake
+		body.responded = func() bool { return writer.flushCount > 0 }
+	}
+
+	writer.enableFlowControl(ctx, cancel, sendWindow(window, chunkWindow(s.ChunkWindow)))
+	writer.tunnelWindow = chunkWindow(s.ChunkWindow)
+	writer.checksums = s.ChunkChecksums
+	writer.enableCompression(negotiateCompression(msg.Header.Get(HeaderAcceptCompression), s.Compression))
+
+	// the only expectation we can meet is 100-continue
+	if expect := req.Header.Get(headerExpect); expect != "" && !expectsContinue(req.Header) {
+		writer.WriteHeader(http.StatusExpectationFailed)
+		return writer.Close()
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = s.recoverHandler(msg, req, writer, p)
+		}
+	}()
+
+	host.handler.ServeHTTP(writer, req)
+
+	// release any resources associated with the body, informing the client if it was not fully consumed
+	_ = req.Body.Close()
+
+	// the handler gave up on a body which was too large without responding
+	if exceededBodyLimit(req.Body) && !writer.headersWritten {
+		writer.release()
+		return s.replyError(msg, &requestError{code: http.StatusRequestEntityTooLarge, err: ErrRequestBodyTooLarge})
+	}
+
+	// the client will have given up by now, so there is no point in completing the response
+	if err = ctx.Err(); err != nil {
+		_ = writer.Abort(err)
+		return err
+	}
 
 	return writer.Close()
 }
 
+// subscribeCancel cancels the request if the client publishes to the subject it announced for cancellation, until
+// the returned function has been called. Only subjects generated with newCancelSubject are accepted, as the Server
+// would otherwise subscribe to any subject a client chose, wildcards included.
+func (s *Server) subscribeCancel(msg *nats.Msg, cancel context.CancelFunc) (release func(), err error) {
+	subject := msg.Header.Get(HeaderCancelSubject)
+	if subject == "" || s.cancels == nil {
+		return func() {}, nil
+	}
+
+	if !isCancelSubject(subject) {
+		return nil, errors.Errorf("natshttp: invalid %s header '%s'", HeaderCancelSubject, subject)
+	}
+
+	return s.cancels.register(subject, cancel), nil
+}
+
+// recoverHandler handles a panic raised by the handler. If the response has not yet started, a 500 Internal Server
+// Error is sent in its place, otherwise the response is aborted. As with net/http, panicking with
+// http.ErrAbortHandler aborts the response without the panic being reported.
+func (s *Server) recoverHandler(msg *nats.Msg, req *http.Request, writer *ResponseWriter, p any) error {
+	_ = req.Body.Close()
+
+	reason := fmt.Errorf("%w: %v", ErrHandlerPanic, p)
+
+	// the stack trace is included when reporting the panic
+	report := fmt.Errorf("%w: %v\n%s", ErrHandlerPanic, p, debug.Stack())
+	if p == http.ErrAbortHandler {
+		report = nil
+	}
+
+	// a response which has started can only be aborted
+	if err := writer.Abort(reason); !errors.Is(err, ErrResponseNotStarted) {
+		return report
+	}
+
+	// otherwise anything the handler buffered is discarded and an error response is sent in its place
+	writer.release()
+
+	if err := s.replyError(msg, reason); err != reason {
+		return err
+	}
+
+	return report
+}
+
+// requestError is a failure to interpret a request, which is reported to the client with the given status code.
+type requestError struct {
+	code int
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return &requestError{code: http.StatusBadRequest, err: err}
+}
+
+// replyError sends an error response for a request which could not be handled, so that the client is not left waiting
+// until it times out. The status code is taken from a requestError, with any other error considered an internal
+// failure whose details are not disclosed to the client. It returns cause, or the error encountered when replying.
+func (s *Server) replyError(msg *nats.Msg, cause error) error {
+	code := http.StatusInternalServerError
+	body := http.StatusText(code)
+
+	var reqErr *requestError
+	if errors.As(cause, &reqErr) {
+		code = reqErr.code
+		body = reqErr.Error()
+	}
+
+	writer, err := NewResponseWriter(s.Conn, msg.Reply)
+	if err != nil {
+		return fmt.Errorf("%w (failed to send error response: %v)", cause, err)
+	}
+
+	writer.Header().Set(headers.ContentType, "text/plain; charset=utf-8")
+	writer.WriteHeader(code)
+
+	if _, err = io.WriteString(writer, body); err == nil {
+		err = writer.Close()
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w (failed to send error response: %v)", cause, err)
+	}
+
+	return cause
+}
+
+// requestContext derives a context for handling msg, bounded by the timeout propagated by the client if present.
+func requestContext(parent context.Context, msg *nats.Msg) (context.Context, context.CancelFunc, error) {
+	value := msg.Header.Get(HeaderTimeout)
+	if value == "" {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, nil
+	}
+
+	timeout, err := parseTimeout(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	return ctx, cancel, nil
+}
+
 func (s *Server) msgToHttpRequest(
+	prefix string,
 	msg *nats.Msg,
 	req *http.Request,
 ) error {
-	if err := MsgToRequest(s.Subject, msg, req); err != nil {
-		return err
+	if err := MsgToRequest(prefix, msg, req); err != nil {
+		return badRequest(err)
 	}
 
-	// copy headers
+	if s.MaxHeaderBytes > 0 && headerSize(msg) > s.MaxHeaderBytes {
+		return &requestError{code: http.StatusRequestHeaderFieldsTooLarge, err: ErrRequestHeaderTooLarge}
+	}
+
+	// copy headers, except those used between the Transport and the Server which remain available from the msg
 	req.Header = make(http.Header)
 	h := req.Header
 
 	for key, values := range msg.Header {
+		if isProtocolHeader(key) {
+			continue
+		}
 		for _, value := range values {
 			h.Add(key, value)
 		}
@@ -142,15 +614,20 @@ func (s *Server) msgToHttpRequest(
 	} else {
 		contentLength, err := strconv.ParseInt(clHeader, 10, 64)
 		if err != nil {
-			return err
+			return badRequest(errors.Annotatef(err, "natshttp: invalid %s header '%s'", headers.ContentLength, clHeader))
 		}
 		req.ContentLength = contentLength
 	}
 
+	// bodies which are known to be too large are rejected before the client sends them
+	if limit := s.MaxRequestBodyBytes; limit > 0 && (req.ContentLength > limit || int64(len(msg.Data)) > limit) {
+		return &requestError{code: http.StatusRequestEntityTooLarge, err: ErrRequestBodyTooLarge}
+	}
+
 	// determine if the request is chunked or not
 	chunked, err := IsChunkedRequest(msg, s.maxMsgSize)
 	if err != nil {
-		return err
+		return badRequest(err)
 	}
 
 	// if not chunked set the body and return
@@ -159,31 +636,109 @@ func (s *Server) msgToHttpRequest(
 		return nil
 	}
 
-	// otherwise we generate a unique inbox for this chunked transfer and send a message to the sender with the
-	// inbox for subsequent messages
+	// the trailer is populated once the body has been read to EOF
+	req.Trailer = declaredTrailer(req.Header)
+	if req.Trailer == nil {
+		req.Trailer = make(http.Header)
+	}
+
+	handshake := func() (io.ReadCloser, error) {
+		return s.startChunkStream(msg, req)
+	}
+
+	// if the client is waiting for permission to send the body, the handshake is deferred until the handler reads it
+	if req.Header.Get(headerExpect) != "" {
+		req.Body = &continueReader{handshake: handshake}
+		return nil
+	}
+
+	req.Body, err = handshake()
+	return err
+}
+
+// startChunkStream generates a unique inbox for receiving the remainder of the request body and sends it to the
+// client as part of the chunk handshake.
+func (s *Server) startChunkStream(msg *nats.Msg, req *http.Request) (io.ReadCloser, error) {
 	chunkedInbox := s.Conn.NewInbox()
 
 	sub, err := s.Conn.SubscribeSync(chunkedInbox)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// set pending limits on the subscription to prevent slow consumer detection in high load scenarios
 	if err = sub.SetPendingLimits(s.PendingMsgsLimit, s.PendingBytesLimit); err != nil {
-		return err
+		_ = sub.Unsubscribe()
+		return nil, err
 	}
 
+	window := chunkWindow(s.ChunkWindow)
+
 	setupMsg := nats.NewMsg(msg.Reply)
 	setupMsg.Reply = chunkedInbox
+	if window > 0 {
+		setupMsg.Header.Set(HeaderChunkWindow, strconv.Itoa(window))
+	}
+	if expectsContinue(req.Header) {
+		setContinueHeaders(setupMsg)
+	}
+	if len(s.Compression) > 0 {
+		setupMsg.Header.Set(HeaderAcceptCompression, strings.Join(s.Compression, ", "))
+	}
 
 	if err = s.Conn.PublishMsg(setupMsg); err != nil {
-		return err
+		_ = sub.Unsubscribe()
+		return nil, err
 	}
 
-	req.Body, err = NewChunkReader(msg, sub, req.Context())
+	reader, err := NewChunkReader(msg, sub, req.Context())
 	if err != nil {
-		return err
+		_ = sub.Unsubscribe()
+		return nil, err
 	}
 
-	return nil
+	reader.enableFlowControl(s.Conn, window)
+	reader.enableDecompression(s.Compression)
+	reader.trailer = req.Trailer
+	reader.limit = s.MaxRequestBodyBytes
+
+	return reader, nil
+}
+
+// isProtocolHeader returns true if key is used by the Transport to describe a request to the Server, rather than
+// being a header of the request itself.
+func isProtocolHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	switch key {
+	case HeaderPath, HeaderQuery, HeaderFragment, HeaderTimeout, HeaderCancelSubject,
+		HeaderAcceptCompression, HeaderCompression, HeaderClientID, HeaderClientName, HeaderClientIP:
+		return true
+	}
+	// flow control and verifying the integrity of chunk streams
+	return strings.HasPrefix(key, "X-Chunk-")
+}
+
+// headerSize approximates the size of the request line and headers of msg as they would be sent over HTTP. Headers
+// used between the Transport and the Server are not counted, as they depend on features the client did not choose.
+func headerSize(msg *nats.Msg) int {
+	size := len(msg.Subject)
+	for key, values := range msg.Header {
+		if isProtocolHeader(key) {
+			continue
+		}
+		for _, value := range values {
+			// key: value\r\n
+			size += len(key) + len(value) + 4
+		}
+	}
+	return size
+}
+
+// exceededBodyLimit returns true if reading body failed because it was larger than MaxRequestBodyBytes.
+func exceededBodyLimit(body io.ReadCloser) bool {
+	if c, ok := body.(*continueReader); ok {
+		body = c.reader
+	}
+	r, ok := body.(*ChunkReader)
+	return ok && r.limitExceeded
 }
@@ -1,13 +1,19 @@
 package natshttp
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/juju/errors"
 	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -53,3 +59,487 @@ func ExampleServer_basic() {
 		panic(err)
 	}
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	routes := chi.NewRouter()
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+
+		n, err := io.Copy(io.Discard, r.Body)
+		assert.Nil(t, err)
+		_, _ = io.WriteString(w, strconv.FormatInt(n, 10))
+	})
+
+	srv := &Server{
+		Conn:    conn,
+		Subject: subject,
+		Handler: routes,
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- srv.Listen(context.Background())
+	}()
+
+	waitForResponders(t, conn)
+
+	// start a chunked upload which is in-flight when the server is shutdown
+	size := int(conn.MaxPayload()) * 3
+	responses := make(chan *http.Response, 1)
+
+	go func() {
+		req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload", bytes.NewReader(make([]byte, size)))
+		assert.Nil(t, err)
+
+		resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+		assert.Nil(t, err)
+		responses <- resp
+	}()
+
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	// new requests are no longer accepted
+	assert.ErrorIs(t, <-listenErr, ErrServerClosed)
+
+	req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload", nil)
+	assert.Nil(t, err)
+	_, err = (&Transport{Conn: conn}).RoundTrip(req)
+	assert.ErrorIs(t, err, ErrNoResponders)
+
+	// shutdown waits for the in-flight request
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown completed before the in-flight request")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	resp := <-responses
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, strconv.Itoa(size), string(b))
+
+	assert.Nil(t, <-shutdownErr)
+
+	// the server cannot be restarted
+	assert.ErrorIs(t, srv.Listen(context.Background()), ErrServerClosed)
+}
+
+func TestServer_Shutdown_Timeout(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Get("/wait", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		cancelled <- r.Context().Err()
+	})
+
+	srv := &Server{
+		Conn:    conn,
+		Subject: subject,
+		Handler: routes,
+	}
+
+	go func() {
+		_ = srv.Listen(context.Background())
+	}()
+
+	waitForResponders(t, conn)
+
+	go func() {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/wait", nil)
+		assert.Nil(t, err)
+		_, _ = (&Transport{Conn: conn, Timeout: 5 * time.Second}).RoundTrip(req)
+	}()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// in-flight requests are cancelled once the shutdown context expires
+	assert.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, <-cancelled, context.Canceled)
+}
+
+func TestServer_MaxConcurrentRequests(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var active, maxActive atomic.Int32
+	started := make(chan struct{}, 8)
+	release := make(chan struct{})
+
+	routes := chi.NewRouter()
+	routes.Get("/work", func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+
+		for {
+			max := maxActive.Load()
+			if n <= max || maxActive.CompareAndSwap(max, n) {
+				break
+			}
+		}
+
+		started <- struct{}{}
+		<-release
+	})
+
+	var saturated atomic.Int32
+
+	srv := &Server{
+		Conn:                  conn,
+		Subject:               subject,
+		Handler:               routes,
+		MaxConcurrentRequests: 2,
+		MaxQueuedRequests:     1,
+		RetryAfter:            1500 * time.Millisecond,
+		ErrorHandler: func(err error) {
+			if errors.Is(err, ErrServerSaturated) {
+				saturated.Add(1)
+			}
+		},
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	transport := &Transport{Conn: conn}
+
+	get := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/work", nil)
+		assert.Nil(t, err)
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	responses := make(chan *http.Response, 3)
+
+	// occupy both workers
+	for i := 0; i < 2; i++ {
+		go func() { responses <- get() }()
+		<-started
+	}
+
+	// fill the queue
+	go func() { responses <- get() }()
+	<-time.After(100 * time.Millisecond)
+
+	// subsequent requests are rejected
+	for i := 0; i < 2; i++ {
+		resp := get()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrServerSaturated.Error(), string(b))
+	}
+
+	assert.Equal(t, int32(2), saturated.Load())
+
+	// once released the queued request is handled
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		resp := <-responses
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.Equal(t, int32(2), maxActive.Load())
+}
+
+func TestServer_ErrorResponses(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "partial")
+		panic("boom")
+	})
+	routes.Get("/panic/streaming", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(make([]byte, conn.MaxPayload()*2))
+		panic("boom")
+	})
+	routes.Get("/abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	errs := make(chan error, 8)
+
+	srv := &Server{
+		Conn:    conn,
+		Subject: subject,
+		Handler: routes,
+		ErrorHandler: func(err error) {
+			errs <- err
+		},
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	// drain errors from waiting for responders
+	for len(errs) > 0 {
+		<-errs
+	}
+
+	transport := &Transport{Conn: conn}
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+path, nil)
+		assert.Nil(t, err)
+		resp, err := transport.RoundTrip(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		resp := get("/panic")
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		// anything the handler wrote is discarded
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusText(http.StatusInternalServerError), string(b))
+
+		err = <-errs
+		assert.ErrorIs(t, err, ErrHandlerPanic)
+		assert.Contains(t, err.Error(), "boom")
+	})
+
+	t.Run("panic while streaming", func(t *testing.T) {
+		resp := get("/panic/streaming")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		_, err := io.ReadAll(resp.Body)
+		assert.ErrorIs(t, err, ErrChunkAborted)
+		assert.ErrorIs(t, <-errs, ErrHandlerPanic)
+	})
+
+	t.Run("abort handler", func(t *testing.T) {
+		resp := get("/abort")
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		// the panic is not reported
+		select {
+		case err := <-errs:
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	for name, msg := range map[string]*nats.Msg{
+		"invalid method": func() *nats.Msg {
+			return nats.NewMsg(subject + ".foo.FETCH")
+		}(),
+		"invalid content length": func() *nats.Msg {
+			msg := nats.NewMsg(subject + ".foo.PUT")
+			msg.Header.Set("Content-Length", "abc")
+			return msg
+		}(),
+		"invalid timeout": func() *nats.Msg {
+			msg := nats.NewMsg(subject + ".foo.GET")
+			msg.Header.Set(HeaderTimeout, "soon")
+			return msg
+		}(),
+		"invalid chunk window": func() *nats.Msg {
+			msg := nats.NewMsg(subject + ".foo.GET")
+			msg.Header.Set(HeaderChunkWindow, "-1")
+			return msg
+		}(),
+	} {
+		msg := msg
+
+		t.Run(name, func(t *testing.T) {
+			resp, err := conn.RequestMsg(msg, time.Second)
+			assert.Nil(t, err)
+			assert.Equal(t, "400", resp.Header.Get(HeaderStatusCode))
+			assert.NotEmpty(t, resp.Data)
+
+			assert.NotNil(t, <-errs)
+		})
+	}
+}
+
+func TestServer_RequestLimits(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	limit := conn.MaxPayload() * 4
+	readErrs := make(chan error, 1)
+
+	routes := chi.NewRouter()
+	routes.Put("/upload", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		readErrs <- err
+		if err == nil {
+			_, _ = io.WriteString(w, strconv.Itoa(len(b)))
+		}
+	})
+
+	held := make(chan struct{})
+	routes.Put("/upload/held", func(w http.ResponseWriter, r *http.Request) {
+		// the response is held back, so only the body limit can stop the client from sending
+		_, err := io.ReadAll(r.Body)
+		readErrs <- err
+		<-held
+	})
+
+	srv := &Server{
+		Conn:                conn,
+		Subject:             subject,
+		Handler:             routes,
+		MaxRequestBodyBytes: limit,
+		MaxHeaderBytes:      1024,
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	transport := &Transport{Conn: conn}
+
+	put := func(t *testing.T, body io.Reader, contentLength int64, h http.Header) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload", body)
+		assert.Nil(t, err)
+		req.ContentLength = contentLength
+		if contentLength < 0 {
+			req.TransferEncoding = []string{"chunked"}
+		}
+		for key, values := range h {
+			req.Header[key] = values
+		}
+		resp, err := transport.RoundTrip(req)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+
+	assertStatus := func(t *testing.T, resp *http.Response, code int, message string) {
+		assert.Equal(t, code, resp.StatusCode)
+		b, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, message, string(b))
+	}
+
+	t.Run("within limits", func(t *testing.T) {
+		resp := put(t, bytes.NewReader(make([]byte, limit)), -1, nil)
+		assertStatus(t, resp, http.StatusOK, strconv.FormatInt(limit, 10))
+		assert.Nil(t, <-readErrs)
+	})
+
+	t.Run("content length", func(t *testing.T) {
+		// the body is rejected before the client sends it
+		reader := &countingReader{Reader: bytes.NewReader(make([]byte, limit+1))}
+		resp := put(t, reader, limit+1, http.Header{"Expect": []string{"100-continue"}})
+		assertStatus(t, resp, http.StatusRequestEntityTooLarge, ErrRequestBodyTooLarge.Error())
+		assert.Less(t, reader.count.Load(), limit)
+		assert.Empty(t, readErrs)
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		size := limit * 16
+		reader := &countingReader{Reader: bytes.NewReader(make([]byte, size))}
+		resp := put(t, reader, -1, nil)
+		assertStatus(t, resp, http.StatusRequestEntityTooLarge, ErrRequestBodyTooLarge.Error())
+
+		var maxBytesErr *http.MaxBytesError
+		assert.ErrorAs(t, <-readErrs, &maxBytesErr)
+		assert.Equal(t, limit, maxBytesErr.Limit)
+
+		// the client stops sending once the limit is crossed
+		assert.Less(t, reader.count.Load(), size)
+	})
+
+	t.Run("chunked without flow control", func(t *testing.T) {
+		size := limit * 16
+		reader := &countingReader{Reader: bytes.NewReader(make([]byte, size))}
+
+		req, err := http.NewRequest(http.MethodPut, "nats+http://"+subject+"/upload/held", reader)
+		assert.Nil(t, err)
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+
+		resps := make(chan *http.Response, 1)
+		go func() {
+			resp, err := (&Transport{Conn: conn, ChunkWindow: -1}).RoundTrip(req)
+			assert.Nil(t, err)
+			resps <- resp
+		}()
+
+		var maxBytesErr *http.MaxBytesError
+		assert.ErrorAs(t, <-readErrs, &maxBytesErr)
+
+		// the client is told to stop even though it does not wait for acknowledgements
+		assert.Never(t, func() bool { return reader.count.Load() == size }, time.Second, 10*time.Millisecond)
+
+		close(held)
+		assertStatus(t, <-resps, http.StatusRequestEntityTooLarge, ErrRequestBodyTooLarge.Error())
+	})
+
+	t.Run("chunked header close to limit", func(t *testing.T) {
+		// the headers used between the Transport and the Server for chunking do not count towards the limit
+		value := string(bytes.Repeat([]byte("a"), 1024-len(subject+".upload.PUT")-len("X-Large")-4-64))
+		resp := put(t, bytes.NewReader(make([]byte, 1024)), -1, http.Header{"X-Large": []string{value}})
+		assertStatus(t, resp, http.StatusOK, "1024")
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, <-readErrs)
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		h := http.Header{"X-Large": []string{string(bytes.Repeat([]byte("a"), 1024))}}
+		resp := put(t, bytes.NewReader(nil), 0, h)
+		assertStatus(t, resp, http.StatusRequestHeaderFieldsTooLarge, ErrRequestHeaderTooLarge.Error())
+		assert.Empty(t, readErrs)
+	})
+}
@@ -0,0 +1,57 @@
+package natshttp
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+const headerTrailer = "Trailer"
+
+// declaredTrailer creates a trailer with a nil value for each key declared in the Trailer header, mirroring how
+// net/http populates http.Request.Trailer and http.Response.Trailer before the body has been read.
+func declaredTrailer(h http.Header) http.Header {
+	var trailer http.Header
+	for _, value := range h.Values(headerTrailer) {
+		for _, key := range strings.Split(value, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if key == "" {
+				continue
+			}
+			if trailer == nil {
+				trailer = make(http.Header)
+			}
+			trailer[key] = nil
+		}
+	}
+	return trailer
+}
+
+// trailerKeys returns the value for a Trailer header announcing the keys of trailer.
+func trailerKeys(trailer http.Header) string {
+	keys := make([]string, 0, len(trailer))
+	for key := range trailer {
+		keys = append(keys, key)
+	}
+	return strings.Join(keys, ",")
+}
+
+// setTrailerHeaders adds the trailer to the final msg of a chunk stream.
+func setTrailerHeaders(msg *nats.Msg, trailer http.Header) {
+	for key, values := range trailer {
+		for _, value := range values {
+			msg.Header.Add(key, value)
+		}
+	}
+}
+
+// readTrailerHeaders copies the trailer from the final msg of a chunk stream, ignoring any protocol headers.
+func readTrailerHeaders(msg *nats.Msg, trailer http.Header) {
+	for key, values := range msg.Header {
+		if key == HeaderChunkSeq || key == HeaderChunkChecksum {
+			continue
+		}
+		trailer[http.CanonicalHeaderKey(key)] = values
+	}
+}
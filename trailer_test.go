@@ -0,0 +1,114 @@
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrailers(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Put("/echo", func(w http.ResponseWriter, r *http.Request) {
+		// the trailer is only populated once the body has been read
+		assert.Empty(t, r.Trailer.Get("X-Request-Checksum"))
+
+		w.Header().Set("Trailer", "X-Checksum")
+
+		// the body is read in full before responding, as a proxy for HTTP/1 clients cannot respond whilst a large
+		// body is still being sent
+		b, err := io.ReadAll(r.Body)
+		assert.Nil(t, err)
+		_, _ = w.Write(b)
+
+		w.Header().Set("X-Checksum", r.Trailer.Get("X-Request-Checksum"))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	runProxy(t, routes, listener, conn, "", ctx)
+
+	for _, size := range []int{16, int(conn.MaxPayload()) * 3} {
+		body := make([]byte, size)
+		_, err := rand.Read(body)
+		assert.Nil(t, err)
+
+		checksum := chunkChecksum(body)
+
+		newRequest := func(t *testing.T, url string) *http.Request {
+			req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+			assert.Nil(t, err)
+			req.Trailer = http.Header{"X-Request-Checksum": nil}
+
+			// trailer values are set once the body has been read, which requires a chunked transfer
+			req.Body = &trailerSettingReader{Reader: req.Body, trailer: req.Trailer, value: checksum}
+			req.ContentLength = -1
+
+			return req
+		}
+
+		assertResponse := func(t *testing.T, resp *http.Response) {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, http.Header{"X-Checksum": nil}, resp.Trailer)
+
+			b, err := io.ReadAll(resp.Body)
+			assert.Nil(t, err)
+			assert.Equal(t, body, b)
+			assert.Nil(t, resp.Body.Close())
+
+			assert.Equal(t, checksum, resp.Trailer.Get("X-Checksum"))
+			assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+		}
+
+		t.Run(fmt.Sprintf("transport/%d", size), func(t *testing.T) {
+			req := newRequest(t, "nats+http://"+subject+"/echo")
+			resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+			assert.Nil(t, err)
+			assertResponse(t, resp)
+		})
+
+		t.Run(fmt.Sprintf("proxy/%d", size), func(t *testing.T) {
+			req := newRequest(t, fmt.Sprintf("http://%s/echo", listener.Addr().String()))
+			resp, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+
+			// net/http only reports declared trailers before the body has been read
+			resp.Trailer = http.Header{"X-Checksum": resp.Trailer["X-Checksum"]}
+			assertResponse(t, resp)
+		})
+	}
+}
+
+type trailerSettingReader struct {
+	io.Reader
+	trailer http.Header
+	value   string
+}
+
+func (r *trailerSettingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if err == io.EOF {
+		r.trailer.Set("X-Request-Checksum", r.value)
+	}
+	return
+}
+
+func (r *trailerSettingReader) Close() error {
+	return nil
+}
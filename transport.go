@@ -2,10 +2,13 @@ package natshttp
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-http-utils/headers"
 	"github.com/juju/errors"
@@ -13,7 +16,9 @@ import (
 )
 
 const (
-	ErrInvalidUrl = errors.ConstError("natshttp: urls must of be of the form 'nats+http://a.valid.nats.subject/foo/bar?query=baz")
+	ErrInvalidUrl   = errors.ConstError("natshttp: urls must of be of the form 'nats+http://a.valid.nats.subject/foo/bar?query=baz")
+	ErrNoResponders = errors.ConstError("natshttp: no responders available for request")
+	ErrNoHeaders    = errors.ConstError("natshttp: nats connection does not support headers")
 )
 
 type Transport struct {
@@ -22,7 +27,33 @@ type Transport struct {
 	PendingMsgsLimit  int
 	PendingBytesLimit int
 
+	// Timeout is applied to requests whose context does not already carry a deadline. A zero value means no timeout.
+	Timeout time.Duration
+
+	// ChunkWindow is the maximum number of response body chunks a server may send before they have been
+	// acknowledged, and is announced to servers as part of each request. Defaults to DefaultChunkWindow, a negative
+	// value disables flow control.
+	ChunkWindow int
+
+	// ChunkChecksums adds a checksum to each chunk of a chunked request body, allowing the server to detect
+	// corruption.
+	ChunkChecksums bool
+
+	// Retry configures how failed requests are retried. A nil value disables retries.
+	Retry *RetryPolicy
+
+	// NoRespondersResponse causes a synthesized 503 Service Unavailable response to be returned when there are no
+	// servers listening on the target subject, instead of ErrNoResponders.
+	NoRespondersResponse bool
+
+	// DisableCompression prevents the Transport from announcing the wire compressions it supports, causing servers
+	// to send response bodies uncompressed, and from compressing request bodies.
+	DisableCompression bool
+
 	maxMsgSize int
+
+	muxLock sync.Mutex
+	mux     *inboxMux
 }
 
 func IsChunkedRequest(msg *nats.Msg, msgSize int) (bool, error) {
@@ -43,6 +74,11 @@ func IsChunkedRequest(msg *nats.Msg, msgSize int) (bool, error) {
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	// headers are required for the protocol and for no responders detection
+	if !t.Conn.HeadersSupported() {
+		return nil, ErrNoHeaders
+	}
+
 	if t.maxMsgSize == 0 {
 		t.maxMsgSize = int(t.Conn.MaxPayload())
 	}
@@ -55,27 +91,122 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		t.PendingBytesLimit = nats.DefaultSubPendingBytesLimit
 	}
 
-	// create response
-	resp = &http.Response{
-		Request: req,
+	// derive a context which carries the effective deadline for this request
+	ctx, cancel := t.requestContext(req)
+	req = req.WithContext(ctx)
+
+	defer func() {
+		if errors.Is(err, ErrNoResponders) && t.NoRespondersResponse {
+			resp, err = noRespondersResponse(req), nil
+		}
+
+		if err != nil {
+			cancel()
+		} else if _, tunnel := resp.Body.(*tunnelConn); tunnel {
+			// the tunnel outlives the request and must remain writable
+			cancel()
+		} else if resp.Body != nil {
+			// the context must outlive RoundTrip as the body may still be streaming
+			resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		} else {
+			cancel()
+		}
+	}()
+
+	if t.Retry == nil {
+		return t.roundTrip(req)
 	}
 
-	// create a new inbox and subscribe to it
-	inbox := t.Conn.NewRespInbox()
-	sub, err := t.Conn.SubscribeSync(inbox)
+	return t.Retry.do(req, t.roundTrip)
+}
 
-	// adjust the pending limits for slow consumer detection
-	if err = sub.SetPendingLimits(t.PendingMsgsLimit, t.PendingBytesLimit); err != nil {
-		return nil, err
+// inboxMux lazily creates the shared response subscription.
+func (t *Transport) inboxMux() (mux *inboxMux, err error) {
+	t.muxLock.Lock()
+	defer t.muxLock.Unlock()
+
+	if t.mux == nil {
+		t.mux, err = newInboxMux(t.Conn, t.PendingMsgsLimit, t.PendingBytesLimit)
+	}
+
+	return t.mux, err
+}
+
+// Close releases the shared response subscription. Requests which are in-flight will fail.
+func (t *Transport) Close() error {
+	t.muxLock.Lock()
+	defer t.muxLock.Unlock()
+
+	if t.mux == nil {
+		return nil
+	}
+
+	err := t.mux.Close()
+	t.mux = nil
+
+	return err
+}
+
+// roundTrip performs a single attempt at sending req and receiving its response.
+func (t *Transport) roundTrip(req *http.Request) (resp *http.Response, err error) {
+	ctx := req.Context()
+
+	// create response
+	resp = &http.Response{
+		Request: req,
 	}
 
-	// todo handle cleanup of subscription in case of error properly
+	mux, err := t.inboxMux()
 	if err != nil {
 		return nil, err
 	}
 
+	// register a new inbox with the shared response subscription
+	inbox := mux.NewInbox()
+
+	// the server is informed if the request is abandoned before the response has been received in full
+	cancelSubject := newCancelSubject(t.Conn)
+	complete := t.propagateCancel(ctx, cancelSubject)
+
+	defer func() {
+		// chunked responses are responsible for unsubscribing when the body is closed
+		if err != nil {
+			if ctx.Err() == nil {
+				// the request failed, so there is nothing to cancel
+				complete()
+			}
+			_ = inbox.Unsubscribe()
+		} else if body, chunked := resp.Body.(*ChunkReader); chunked {
+			body.onEOF = complete
+		} else if _, tunnel := resp.Body.(*tunnelConn); tunnel {
+			// the tunnel is responsible for unsubscribing when it is closed
+			complete()
+		} else {
+			complete()
+			_ = inbox.Unsubscribe()
+		}
+	}()
+
+	// the upload is cancelled if we stop sending chunks early
+	uploadCtx, cancelUpload := context.WithCancel(ctx)
+
+	// chunked requests need an inbox on which the server acknowledges the chunks it has consumed
+	acks := mux.NewInbox()
+
+	// once the remainder of the body is being sent in the background, it is responsible for releasing both
+	uploading := false
+	defer func() {
+		if err != nil || !uploading {
+			cancelUpload()
+			_ = acks.Unsubscribe()
+		}
+	}()
+
+	// receives the compression agreed with the server once it has accepted the body
+	proceed := make(chan string, 1)
+
 	// convert the request into a stream of one or more messages
-	reqMsgs, err := t.httpRequestToMsgs(req)
+	reqMsgs, err := t.httpRequestToMsgs(req.WithContext(uploadCtx), acks.Subject, cancelSubject, proceed)
 	if err != nil {
 		return nil, err
 	}
@@ -85,72 +216,195 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		return nil, firstMsg.Error
 	}
 
-	// set reply to our inbox and publish
-	firstMsg.Value.Reply = inbox
-	if err = t.Conn.PublishMsg(firstMsg.Value); err != nil {
-		return nil, err
-	}
-
 	// determine if the request is chunked or not
 	chunked, err := IsChunkedRequest(firstMsg.Value, t.maxMsgSize)
 	if err != nil {
 		return nil, err
 	}
 
+	// set reply to our inbox and publish
+	firstMsg.Value.Reply = inbox.Subject
+	if err = t.Conn.PublishMsg(firstMsg.Value); err != nil {
+		return nil, err
+	}
+
 	// if the request is not chunked we can start processing the responses
 	if !chunked {
-		err = t.processResponses(resp, sub)
+		err = t.processResponses(resp, inbox)
 		return resp, err
 	}
 
 	// otherwise we wait for the chunk handshake
-	ctx := req.Context()
 	var chunkSubject string
 
 	// listen for the first response msg which will contain a private inbox for sending the remainder of the chunks
-	msg, err := sub.NextMsgWithContext(ctx)
+	msg, err := awaitMsg(ctx, inbox)
 	if err != nil {
 		return nil, err
 	}
 
+	// the server has responded without accepting the body, most likely to reject it, so the upload is abandoned
+	if isFinalResponse(msg) {
+		err = t.processResponse(resp, msg, inbox)
+		return resp, err
+	}
+
 	chunkSubject = msg.Reply
 	if chunkSubject == "" {
 		return nil, errors.New("natshttp: invalid chunk handshake")
 	}
 
-	// send the remainder of the chunks
-Loop:
+	// the server announces how many chunks it is willing to buffer
+	window, err := parseChunkWindow(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	fc := newFlowControl(sendWindow(window, chunkWindow(t.ChunkWindow)), acks)
+
+	proceed <- t.requestCompression(req, msg)
+
+	// the response can start before the body has been sent in full, for example when the handler echoes the body,
+	// so the remainder of the body is sent in the background whilst the response is being received
+	responseCtx, failUpload := context.WithCancelCause(ctx)
+	defer failUpload(nil)
+
+	uploading = true
+	go func() {
+		defer func() {
+			cancelUpload()
+			_ = acks.Unsubscribe()
+		}()
+		if err := t.upload(ctx, reqMsgs, fc, chunkSubject); err != nil {
+			failUpload(err)
+		}
+	}()
+
+	msg, err = awaitMsg(responseCtx, inbox)
+	if err != nil {
+		// report why the upload failed, rather than the cancellation it caused
+		if cause := context.Cause(responseCtx); cause != nil {
+			err = cause
+		}
+		return nil, err
+	}
+
+	err = t.processResponse(resp, msg, inbox)
+	return resp, err
+}
+
+// requestCompression selects the compression for the remainder of a chunked request body from those the server
+// accepted during the chunk handshake. An empty string indicates no compression.
+func (t *Transport) requestCompression(req *http.Request, handshake *nats.Msg) string {
+	// bodies which are small or already encoded are not worth compressing
+	if t.DisableCompression || req.Header.Get(headers.ContentEncoding) != "" ||
+		(req.ContentLength >= 0 && req.ContentLength < minCompressionSize) {
+		return ""
+	}
+	return negotiateCompression(handshake.Header.Get(HeaderAcceptCompression), SupportedCompression)
+}
+
+// upload sends the remainder of the chunks of a request body to chunkSubject, informing the server if it fails as
+// otherwise it would wait for chunks which will never arrive.
+func (t *Transport) upload(
+	ctx context.Context,
+	reqMsgs <-chan Result[*nats.Msg],
+	fc *flowControl,
+	chunkSubject string,
+) (err error) {
+	defer func() {
+		if err != nil {
+			_ = t.Conn.PublishMsg(newAbortMsg(chunkSubject, err))
+		}
+	}()
+
 	for {
 		select {
-		case <-req.Context().Done():
-			return nil, req.Context().Err()
+		case <-ctx.Done():
+			return ctx.Err()
 		case chunk, ok := <-reqMsgs:
 			if !ok {
-				break Loop
+				return nil
 			}
 			if chunk.Error != nil {
-				return nil, chunk.Error
+				return chunk.Error
+			}
+			if err = fc.acquire(ctx); errors.Is(err, ErrReceiverClosed) {
+				// the server has stopped reading the body, most likely it has responded early
+				return nil
+			} else if err != nil {
+				return err
 			}
 			chunk.Value.Subject = chunkSubject
 			if err = t.Conn.PublishMsg(chunk.Value); err != nil {
-				return nil, err
+				return err
 			}
 		}
 	}
-
-	// process responses
-	err = t.processResponses(resp, sub)
-	return resp, err
 }
 
-func (t *Transport) processResponses(resp *http.Response, sub *nats.Subscription) error {
-	ctx := resp.Request.Context()
+// propagateCancel publishes to subject if ctx is done before the returned function has been called, indicating that
+// the response has been received in full.
+func (t *Transport) propagateCancel(ctx context.Context, subject string) (complete func()) {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = t.Conn.Publish(subject, nil)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
 
+// awaitMsg waits for the next msg on sub, translating a no responders status into ErrNoResponders.
+func awaitMsg(ctx context.Context, sub Subscription) (*nats.Msg, error) {
 	msg, err := sub.NextMsgWithContext(ctx)
+	if errors.Is(err, nats.ErrNoResponders) || (err == nil && isNoResponders(msg)) {
+		return nil, ErrNoResponders
+	}
+	return msg, err
+}
+
+func noRespondersResponse(req *http.Request) *http.Response {
+	statusCode := http.StatusServiceUnavailable
+	return &http.Response{
+		Status:        http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       req,
+	}
+}
+
+func (t *Transport) requestContext(req *http.Request) (context.Context, context.CancelFunc) {
+	ctx := req.Context()
+	if _, ok := ctx.Deadline(); ok || t.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, t.Timeout)
+}
+
+func (t *Transport) processResponses(resp *http.Response, inbox Subscription) error {
+	msg, err := awaitMsg(resp.Request.Context(), inbox)
 	if err != nil {
 		return err
 	}
+	return t.processResponse(resp, msg, inbox)
+}
 
+// processResponse populates resp from the first msg of the response, reading any remaining chunks from inbox.
+func (t *Transport) processResponse(resp *http.Response, msg *nats.Msg, inbox Subscription) error {
+	ctx := resp.Request.Context()
 	h := msg.Header
 
 	statusCode, err := strconv.ParseInt(h.Get(HeaderStatusCode), 10, 64)
@@ -161,9 +415,13 @@ func (t *Transport) processResponses(resp *http.Response, sub *nats.Subscription
 	resp.Status = h.Get(HeaderStatus)
 	resp.StatusCode = int(statusCode)
 
-	// copy headers
+	// copy headers, except those used for flow control and verifying the integrity of the chunk stream
 	resp.Header = make(http.Header)
 	for key, values := range h {
+		switch key {
+		case HeaderChunkWindow, HeaderChunkAckSubject, HeaderChunkSeq, HeaderChunkChecksum:
+			continue
+		}
 		for _, value := range values {
 			resp.Header.Add(key, value)
 		}
@@ -173,6 +431,7 @@ func (t *Transport) processResponses(resp *http.Response, sub *nats.Subscription
 	if transferEncoding != "" {
 		resp.Header.Del("Content-Length")
 		resp.TransferEncoding = []string{transferEncoding}
+		resp.ContentLength = -1
 	}
 
 	contentLength := resp.Header.Get("Content-Length")
@@ -184,24 +443,82 @@ func (t *Transport) processResponses(resp *http.Response, sub *nats.Subscription
 		resp.ContentLength = cl
 	}
 
+	// the server has switched protocols, with the body becoming a tunnel for reading and writing
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if msg.Reply == "" {
+			return errors.New("natshttp: invalid protocol switch")
+		}
+		resp.ContentLength = -1
+		return t.openTunnel(resp, msg, inbox)
+	}
+
+	// the body is decompressed transparently
+	encoding := resp.Header.Get(HeaderCompression)
+	resp.Header.Del(HeaderCompression)
+
 	totalBytes := msg.Size() - len(msg.Data) + int(resp.ContentLength)
 
 	if transferEncoding != "chunked" && totalBytes < t.maxMsgSize {
 		resp.Body = io.NopCloser(bytes.NewReader(msg.Data))
-		return nil
+		if encoding != "" {
+			resp.Body, err = newDecompressor(encoding, bytes.NewReader(msg.Data))
+		}
+		return err
 	}
 
-	bodyReader, err := NewChunkReader(msg, sub, ctx)
+	bodyReader, err := NewChunkReader(msg, inbox, ctx)
 	if err != nil {
 		return err
 	}
 
+	bodyReader.enableFlowControl(t.Conn, chunkWindow(t.ChunkWindow))
+	if !t.DisableCompression {
+		// only the encodings announced with the request can have been used by the server
+		bodyReader.enableDecompression(SupportedCompression)
+	}
+
+	// the trailer is populated once the body has been read to EOF
+	resp.Trailer = declaredTrailer(resp.Header)
+	if resp.Trailer == nil {
+		resp.Trailer = make(http.Header)
+	}
+	bodyReader.trailer = resp.Trailer
+
 	resp.Body = bodyReader
 
 	return nil
 }
 
-func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg], error) {
+// openTunnel sets the body of resp to the client end of the tunnel established by msg, which switched protocols.
+func (t *Transport) openTunnel(resp *http.Response, msg *nats.Msg, inbox Subscription) error {
+	window, err := parseChunkWindow(msg)
+	if err != nil {
+		return err
+	}
+
+	mux, err := t.inboxMux()
+	if err != nil {
+		return err
+	}
+
+	// the server acknowledges the data it consumes on an inbox announced with the first chunk
+	acks := mux.NewInbox()
+
+	tunnel := newTunnelConn(t.Conn, msg.Reply, inbox, tunnelAddr(msg.Subject), t.ChunkChecksums)
+	tunnel.enableFlowControl(acks, sendWindow(window, chunkWindow(t.ChunkWindow)), chunkWindow(t.ChunkWindow))
+	tunnel.announce = acks.Subject
+	tunnel.ackSubject = msg.Header.Get(HeaderChunkAckSubject)
+
+	resp.Body = tunnel
+	return nil
+}
+
+func (t *Transport) httpRequestToMsgs(
+	req *http.Request,
+	ackSubject string,
+	cancelSubject string,
+	proceed <-chan string,
+) (chan Result[*nats.Msg], error) {
 	var err error
 	msgs := make(chan Result[*nats.Msg], 8)
 
@@ -233,16 +550,54 @@ func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg]
 
 	h := msg.Header
 
+	// announce how many response chunks we are willing to buffer
+	if window := chunkWindow(t.ChunkWindow); window > 0 {
+		h.Set(HeaderChunkWindow, strconv.Itoa(window))
+	}
+
+	// let the server know where to listen for the request being cancelled
+	h.Set(HeaderCancelSubject, cancelSubject)
+
+	// let the server know who is sending the request
+	setClientInfoHeaders(t.Conn, h)
+
+	// let the server know it may compress the response
+	if !t.DisableCompression {
+		h.Set(HeaderAcceptCompression, strings.Join(SupportedCompression, ", "))
+	}
+
+	// propagate the deadline so the server can bound the handler accordingly
+	if deadline, ok := req.Context().Deadline(); ok {
+		h.Set(HeaderTimeout, formatTimeout(time.Until(deadline)))
+	}
+
+	// trailers can only be sent at the end of a chunk stream
+	hasTrailer := req.Body != nil && len(req.Trailer) > 0
+
 	if len(req.TransferEncoding) > 0 {
 		h.Set(headers.TransferEncoding, strings.Join(req.TransferEncoding, ","))
+	} else if hasTrailer {
+		h.Set(headers.TransferEncoding, "chunked")
+	} else if req.Body != nil && req.ContentLength > 0 {
+		// the server relies on the content length to determine if the body will be chunked
+		h.Set(headers.ContentLength, strconv.FormatInt(req.ContentLength, 10))
 	}
 
 	for key, values := range req.Header {
+		// framing headers are determined by the request fields above
+		switch http.CanonicalHeaderKey(key) {
+		case headers.ContentLength, headers.TransferEncoding, headerTrailer:
+			continue
+		}
 		for _, value := range values {
 			msg.Header.Add(key, value)
 		}
 	}
 
+	if hasTrailer {
+		h.Set(headerTrailer, trailerKeys(req.Trailer))
+	}
+
 	// empty body so return the msg with just headers
 	if req.Body == nil {
 		msgs <- Result[*nats.Msg]{Value: msg}
@@ -253,7 +608,7 @@ func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg]
 	chunked := false
 
 	te := req.TransferEncoding
-	if len(te) > 0 && te[0] == "chunked" {
+	if (len(te) > 0 && te[0] == "chunked") || hasTrailer {
 		chunked = true
 	}
 
@@ -281,24 +636,87 @@ func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg]
 		return msgs, nil
 	}
 
+	// let the receiver know where to acknowledge the chunks it consumes
+	h.Set(HeaderChunkAckSubject, ackSubject)
+
+	// the body is withheld until the server has accepted it, allowing it to be rejected without being sent
+	expectContinue := expectsContinue(req.Header)
+
 	var n int
 	readBuffer := make([]byte, t.maxMsgSize)
 
+	ctx := req.Context()
+
+	// send blocks until the msg has been accepted or the request has been abandoned
+	send := func(result Result[*nats.Msg]) bool {
+		select {
+		case msgs <- result:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
 	go func() {
 		// initialise to the first msg under construction
 		nextMsg := msg
+		seq := 0
+
+		var body io.Reader = req.Body
+		encoding := ""
 
 		defer func() {
 			close(msgs)
 			_ = req.Body.Close()
 		}()
 
+		// the remainder of the body is not sent until the server has accepted it, at which point it may also have
+		// agreed to it being compressed
+		awaitProceed := func() bool {
+			select {
+			case encoding = <-proceed:
+			case <-ctx.Done():
+				return false
+			}
+			if encoding != "" {
+				compressed, err := newCompressingReader(encoding, req.Body)
+				if err != nil {
+					send(Result[*nats.Msg]{Error: err})
+					return false
+				}
+				body = compressed
+			}
+			return true
+		}
+
+		if expectContinue {
+			// the first msg carries only the headers
+			reserveChunkHeaders(nextMsg, seq, false)
+			seq += 1
+
+			if !send(Result[*nats.Msg]{Value: nextMsg}) || !awaitProceed() {
+				return
+			}
+
+			nextMsg = nats.NewMsg("")
+		}
+
 		for {
 			select {
-			case <-req.Context().Done():
-				msgs <- Result[*nats.Msg]{Error: req.Context().Err()}
+			case <-ctx.Done():
+				// the consumer is also watching the context and will report the error
+				return
 			default:
 
+				// the first compressed chunk announces the compression of the remainder of the stream
+				if encoding != "" && seq == 1 {
+					nextMsg.Header.Set(HeaderCompression, encoding)
+				}
+
+				// sequence and checksum headers must be accounted for when sizing the data field
+				reserveChunkHeaders(nextMsg, seq, t.ChunkChecksums)
+				seq += 1
+
 				// determine the max size for the data field
 				dataSize := t.maxMsgSize - nextMsg.Size()
 
@@ -314,10 +732,10 @@ func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg]
 				}
 
 				// read into the data buffer
-				n, err = req.Body.Read(dataBuffer)
+				n, err = body.Read(dataBuffer)
 
 				if err != nil && err != io.EOF {
-					msgs <- Result[*nats.Msg]{Error: err}
+					send(Result[*nats.Msg]{Error: err})
 					return
 				}
 
@@ -326,16 +744,36 @@ func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg]
 				copied := copy(nextMsg.Data, dataBuffer)
 
 				if copied != n {
-					msgs <- Result[*nats.Msg]{Error: errors.New("natshttp: failed to copy all bytes into msg.Data")}
+					send(Result[*nats.Msg]{Error: errors.New("natshttp: failed to copy all bytes into msg.Data")})
 					return
 				}
 
-				msgs <- Result[*nats.Msg]{Value: nextMsg}
+				// an empty chunk would be mistaken for the end of the stream, so instead it becomes the end of the
+				// stream, unless it is the first msg which carries the request headers
+				if err == io.EOF && n == 0 && nextMsg != msg {
+					setTrailerHeaders(nextMsg, req.Trailer)
+					sealChunk(nextMsg)
+					send(Result[*nats.Msg]{Value: nextMsg})
+					return
+				}
+
+				sealChunk(nextMsg)
+
+				if !send(Result[*nats.Msg]{Value: nextMsg}) {
+					return
+				}
 
 				if err == io.EOF {
-					// send an empty message to indicate the end of the stream of chunks
+					// send an empty message to indicate the end of the stream of chunks, the request body has
+					// been fully read so any trailer values will have been populated
 					nextMsg = nats.NewMsg("")
-					msgs <- Result[*nats.Msg]{Value: nextMsg}
+					setTrailerHeaders(nextMsg, req.Trailer)
+					reserveChunkHeaders(nextMsg, seq, false)
+					send(Result[*nats.Msg]{Value: nextMsg})
+					return
+				}
+
+				if nextMsg == msg && !awaitProceed() {
 					return
 				}
 
@@ -348,3 +786,14 @@ func (t *Transport) httpRequestToMsgs(req *http.Request) (chan Result[*nats.Msg]
 
 	return msgs, nil
 }
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -1,10 +1,17 @@
 package natshttp
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
+	"testing"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
 )
 
 func ExampleTransport_basic() {
@@ -36,3 +43,162 @@ func ExampleTransport_basic() {
 
 	println(string(body))
 }
+
+func TestTransport_Deadline(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handlerErr := make(chan error, 1)
+	returned := make(chan struct{})
+
+	routes := chi.NewRouter()
+	routes.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			handlerErr <- errors.New("request context has no deadline")
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			handlerErr <- r.Context().Err()
+			// hold back the response until the client has observed its own deadline
+			<-returned
+		case <-time.After(5 * time.Second):
+			handlerErr <- errors.New("handler was not cancelled")
+		}
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	client := http.Client{
+		Transport: &Transport{
+			Conn:    conn,
+			Timeout: 250 * time.Millisecond,
+		},
+	}
+
+	start := time.Now()
+	_, err := client.Get("nats+http://" + subject + "/slow")
+	close(returned)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	select {
+	case err = <-handlerErr:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("handler did not observe the deadline")
+	}
+}
+
+func TestTransport_NoResponders(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	small := []byte("hello world")
+	large := make([]byte, conn.MaxPayload()*2)
+
+	for name, body := range map[string][]byte{"small": small, "large": large} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			newRequest := func() *http.Request {
+				req, err := http.NewRequestWithContext(ctx, http.MethodPost, "nats+http://"+subject+"/", bytes.NewReader(body))
+				assert.Nil(t, err)
+				return req
+			}
+
+			start := time.Now()
+			_, err := (&Transport{Conn: conn}).RoundTrip(newRequest())
+			assert.ErrorIs(t, err, ErrNoResponders)
+
+			resp, err := (&Transport{Conn: conn, NoRespondersResponse: true}).RoundTrip(newRequest())
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+			assert.Nil(t, resp.Body.Close())
+
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
+
+func TestTransport_Close(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan struct{})
+
+	routes := chi.NewRouter()
+	routes.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-r.Context().Done()
+	})
+
+	runServer(t, routes, conn, ctx)
+
+	transport := &Transport{Conn: conn}
+
+	errs := make(chan error, 1)
+	go func() {
+		// the request has no deadline, so only closing the transport can end it
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/slow", nil)
+		assert.Nil(t, err)
+		_, err = transport.RoundTrip(req)
+		errs <- err
+	}()
+
+	<-received
+	assert.Nil(t, transport.Close())
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrInboxClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight request did not fail when the transport was closed")
+	}
+}
+
+func BenchmarkTransport_RoundTrip(b *testing.B) {
+	s := runBasicNatsServer(b)
+	defer shutdownNatsServer(b, s)
+	conn := client(b, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Get("/hello", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "world")
+	})
+
+	runServer(b, routes, conn, ctx)
+
+	transport := &Transport{Conn: conn}
+	defer func() { _ = transport.Close() }()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/hello", nil)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	})
+}
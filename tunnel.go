@@ -0,0 +1,461 @@
+package natshttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	ErrHijackNotUpgrade = errors.ConstError("natshttp: only a response which switches protocols can be hijacked")
+)
+
+// headTerminator marks the end of a response head written to a hijacked connection.
+var headTerminator = []byte("\r\n\r\n")
+
+// tunnelAddr identifies one end of a tunnel by the subject on which it receives data.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "nats"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// tunnelConn is a full-duplex byte stream between a client and a server, established once the server has switched
+// protocols in response to an upgrade request. Each direction is a sequence of chunks in the same format as a chunk
+// stream, with an empty chunk indicating that the sender will not write any more data. Both directions are subject to
+// the same flow control as chunk streams, with the server announcing its window and ack subject when switching
+// protocols, and the client announcing its ack subject in its first chunk.
+type tunnelConn struct {
+	conn      *nats.Conn
+	subject   string
+	sub       Subscription
+	checksums bool
+
+	local  net.Addr
+	remote net.Addr
+
+	// cancelled when the connection is closed, interrupting any pending reads
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	readLock      sync.Mutex
+	reader        *bytes.Reader
+	received      int
+	readErr       error
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	writeLock   sync.Mutex
+	sent        int
+	writeClosed bool
+	writeErr    error
+
+	// flow control, where the peer acknowledges the chunks it consumes on acks, and the chunks consumed from the
+	// peer are acknowledged to ackSubject. The client announces the subject of acks with its first chunk.
+	fc         *flowControl
+	acks       Subscription
+	announce   string
+	ackLock    sync.Mutex
+	ackSubject string
+	ackEvery   int
+	consumed   int
+
+	// when a handler hijacks the connection before switching protocols, the response head it writes is buffered
+	// until complete and then passed to onHead
+	head   *bytes.Buffer
+	onHead func(resp *http.Response) error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newTunnelConn creates one end of a tunnel, sending data to subject and receiving data from sub.
+func newTunnelConn(conn *nats.Conn, subject string, sub Subscription, local net.Addr, checksums bool) *tunnelConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tunnelConn{
+		conn:      conn,
+		subject:   subject,
+		sub:       sub,
+		checksums: checksums,
+		local:     local,
+		remote:    tunnelAddr(subject),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// enableFlowControl waits for acknowledgements on acks once window chunks are in-flight to the peer, and acknowledges
+// the chunks received from the peer at an interval derived from the window announced to it.
+func (c *tunnelConn) enableFlowControl(acks Subscription, window int, receiveWindow int) {
+	c.acks = acks
+	c.fc = newFlowControl(window, acks)
+	c.ackEvery = ackInterval(receiveWindow)
+}
+
+func (c *tunnelConn) Read(p []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for c.reader == nil || c.reader.Len() == 0 {
+		// errors are sticky as the stream cannot be recovered
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		ctx, cancel := c.readContext()
+		msg, err := c.sub.NextMsgWithContext(ctx)
+		cancel()
+
+		if c.ctx.Err() != nil {
+			return 0, net.ErrClosed
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			return 0, os.ErrDeadlineExceeded
+		} else if err != nil {
+			return 0, err
+		}
+
+		if c.readErr = abortError(msg); c.readErr != nil {
+			continue
+		}
+
+		// ensure we haven't missed any chunks and the chunk is intact
+		if c.readErr = verifyChunk(msg, c.received); c.readErr != nil {
+			continue
+		}
+
+		// the client announces where to acknowledge its chunks with the first of them
+		if c.received == 0 && msg.Header.Get(HeaderChunkAckSubject) != "" {
+			c.ackLock.Lock()
+			c.ackSubject = msg.Header.Get(HeaderChunkAckSubject)
+			c.ackLock.Unlock()
+		}
+
+		c.received += 1
+
+		// empty data indicates the peer has stopped writing
+		if len(msg.Data) == 0 {
+			c.readErr = io.EOF
+			continue
+		}
+
+		if c.readErr = c.ack(c.received); c.readErr != nil {
+			continue
+		}
+
+		c.reader = bytes.NewReader(msg.Data)
+	}
+
+	return c.reader.Read(p)
+}
+
+// ack records the consumption of chunks from the peer, periodically acknowledging them.
+func (c *tunnelConn) ack(consumed int) error {
+	c.ackLock.Lock()
+	defer c.ackLock.Unlock()
+
+	c.consumed = consumed
+	if c.ackSubject == "" || c.ackEvery == 0 || consumed%c.ackEvery != 0 {
+		return nil
+	}
+	return c.conn.PublishMsg(newAckMsg(c.ackSubject, consumed))
+}
+
+func (c *tunnelConn) readContext() (context.Context, context.CancelFunc) {
+	c.deadlineLock.Lock()
+	deadline := c.readDeadline
+	c.deadlineLock.Unlock()
+
+	return c.deadlineContext(deadline)
+}
+
+func (c *tunnelConn) writeContext() (context.Context, context.CancelFunc) {
+	c.deadlineLock.Lock()
+	deadline := c.writeDeadline
+	c.deadlineLock.Unlock()
+
+	return c.deadlineContext(deadline)
+}
+
+func (c *tunnelConn) deadlineContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.WithCancel(c.ctx)
+	}
+	return context.WithDeadline(c.ctx, deadline)
+}
+
+func (c *tunnelConn) Write(p []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.writeClosed {
+		return 0, net.ErrClosed
+	}
+
+	// errors are sticky as the stream cannot be recovered
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+
+	if c.head != nil {
+		return c.writeHead(p)
+	}
+
+	return c.write(p)
+}
+
+// writeHead buffers the response head written by a handler which hijacked the connection, passing it to onHead once
+// complete. Anything written after the head is sent as data.
+func (c *tunnelConn) writeHead(p []byte) (n int, err error) {
+	c.head.Write(p)
+
+	idx := bytes.Index(c.head.Bytes(), headTerminator)
+	if idx < 0 {
+		return len(p), nil
+	}
+
+	head := c.head.Bytes()[:idx+len(headTerminator)]
+	rest := c.head.Bytes()[len(head):]
+	c.head = nil
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = c.onHead(resp); err != nil {
+		return 0, err
+	}
+
+	if _, err = c.write(rest); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// write sends p to the peer, splitting it across as many chunks as required.
+func (c *tunnelConn) write(p []byte) (n int, err error) {
+	for n < len(p) {
+		if err = c.acquire(); err != nil {
+			return
+		}
+
+		msg := c.newChunk()
+
+		size := int(c.conn.MaxPayload()) - msg.Size()
+		if remaining := len(p) - n; remaining < size {
+			size = remaining
+		}
+
+		msg.Data = p[n : n+size]
+		sealChunk(msg)
+
+		if err = c.conn.PublishMsg(msg); err != nil {
+			return
+		}
+
+		c.sent += 1
+		n += size
+	}
+	return
+}
+
+// acquire waits for credit before sending a chunk to the peer.
+func (c *tunnelConn) acquire() error {
+	if c.fc == nil {
+		return nil
+	}
+
+	ctx, cancel := c.writeContext()
+	err := c.fc.acquire(ctx)
+	cancel()
+
+	switch {
+	case c.ctx.Err() != nil:
+		return net.ErrClosed
+	case errors.Is(err, context.DeadlineExceeded):
+		// the write can be retried once the deadline has been extended
+		return os.ErrDeadlineExceeded
+	case err != nil:
+		c.writeErr = err
+	}
+	return err
+}
+
+// newChunk creates the next chunk to be sent to the peer.
+func (c *tunnelConn) newChunk() *nats.Msg {
+	msg := nats.NewMsg(c.subject)
+	if c.sent == 0 && c.announce != "" {
+		msg.Header.Set(HeaderChunkAckSubject, c.announce)
+	}
+	reserveChunkHeaders(msg, c.sent, c.checksums)
+	return msg
+}
+
+// CloseWrite informs the peer that no more data will be written, whilst allowing data to be read until the peer does
+// the same.
+func (c *tunnelConn) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.writeClosed {
+		return nil
+	}
+
+	c.writeClosed = true
+
+	// the end of the stream does not need credit, as the peer has nothing to buffer
+	return c.conn.PublishMsg(c.newChunk())
+}
+
+func (c *tunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		// interrupt any pending reads, and writes waiting for credit
+		c.cancel()
+		c.closeErr = c.CloseWrite()
+
+		// the peer stops writing, rather than waiting for credit which will never be granted
+		c.ackLock.Lock()
+		if c.ackSubject != "" {
+			_ = c.conn.PublishMsg(newClosedMsg(c.ackSubject, c.consumed))
+		}
+		c.ackLock.Unlock()
+
+		if err := c.sub.Unsubscribe(); c.closeErr == nil {
+			c.closeErr = err
+		}
+		if c.acks != nil {
+			_ = c.acks.Unsubscribe()
+		}
+	})
+	return c.closeErr
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tunnelConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *tunnelConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline bounds how long writes wait for the peer to grant credit.
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// Hijack implements http.Hijacker for handlers which switch protocols in response to an upgrade request, such as
+// WebSocket handlers. The response must either be written with a status of 101 Switching Protocols before calling
+// Hijack, or written as a raw HTTP response head to the returned connection. The connection remains open after the
+// handler returns, until it is closed.
+func (r *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+
+	if r.closed {
+		return nil, nil, ErrResponseClosed
+	}
+
+	if r.flushCount > 0 || (r.headersWritten && r.headers.Get(HeaderStatusCode) != "101") {
+		return nil, nil, ErrHijackNotUpgrade
+	}
+
+	// data from the client is received on a private inbox, which is announced when switching protocols
+	sub, err := r.conn.SubscribeSync(r.conn.NewInbox())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// as is the inbox on which the client acknowledges the data it consumes
+	acks, err := r.conn.SubscribeSync(r.conn.NewInbox())
+	if err != nil {
+		_ = sub.Unsubscribe()
+		return nil, nil, err
+	}
+
+	tunnel := newTunnelConn(r.conn, r.subject, sub, tunnelAddr(sub.Subject), r.checksums)
+	tunnel.enableFlowControl(acks, r.window, r.tunnelWindow)
+
+	// the response writer is no longer responsible for the stream
+	r.hijacked = true
+	r.closed = true
+	r.release()
+	r.compression = ""
+
+	if r.headersWritten {
+		err = r.switchProtocols(sub.Subject, acks.Subject)
+	} else {
+		tunnel.head = bytes.NewBuffer(nil)
+		tunnel.onHead = func(resp *http.Response) error {
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				return ErrHijackNotUpgrade
+			}
+			for key, values := range resp.Header {
+				r.headers[key] = values
+			}
+			r.WriteHeader(resp.StatusCode)
+			return r.switchProtocols(sub.Subject, acks.Subject)
+		}
+	}
+
+	if err != nil {
+		_ = sub.Unsubscribe()
+		_ = acks.Unsubscribe()
+		return nil, nil, err
+	}
+
+	return tunnel, bufio.NewReadWriter(bufio.NewReader(tunnel), bufio.NewWriter(tunnel)), nil
+}
+
+// switchProtocols sends the response head, announcing the inbox on which the server will receive data from the client,
+// and the window and inbox for acknowledging the data the client consumes.
+func (r *ResponseWriter) switchProtocols(inbox string, acks string) error {
+	msg := nats.NewMsg(r.subject)
+	msg.Reply = inbox
+	msg.Header = r.msgHeader()
+	msg.Header.Set(HeaderChunkAckSubject, acks)
+	if r.tunnelWindow > 0 {
+		msg.Header.Set(HeaderChunkWindow, strconv.Itoa(r.tunnelWindow))
+	}
+
+	if err := r.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	r.flushCount += 1
+	return nil
+}
@@ -0,0 +1,305 @@
+package natshttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoTunnel switches to a protocol which echoes anything it receives until the client stops writing.
+func echoTunnel(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+
+		var conn net.Conn
+		var brw *bufio.ReadWriter
+		var err error
+
+		switch r.URL.Query().Get("mode") {
+		case "raw":
+			// the response head is written to the hijacked connection, as done by gorilla/websocket
+			conn, brw, err = http.NewResponseController(w).Hijack()
+			assert.Nil(t, err)
+			_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			assert.Nil(t, err)
+		default:
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "echo")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			conn, brw, err = http.NewResponseController(w).Hijack()
+			assert.Nil(t, err)
+		}
+
+		// the connection outlives the handler
+		go func() {
+			defer func() { _ = conn.Close() }()
+			_, _ = io.Copy(conn, brw)
+		}()
+	}
+}
+
+func assertEcho(t *testing.T, conn io.ReadWriter, size int) {
+	t.Helper()
+
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	assert.Nil(t, err)
+
+	// write concurrently as the echo does not start until the first chunk arrives
+	go func() {
+		_, err := conn.Write(data)
+		assert.Nil(t, err)
+	}()
+
+	echoed := make([]byte, size)
+	_, err = io.ReadFull(conn, echoed)
+	assert.Nil(t, err)
+	assert.Equal(t, data, echoed)
+}
+
+func TestTunnel(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	routes := chi.NewRouter()
+	routes.Get("/echo", echoTunnel(t))
+	routes.Get("/not-upgraded", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _, err := http.NewResponseController(w).Hijack()
+		assert.ErrorIs(t, err, ErrHijackNotUpgrade)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	runProxy(t, routes, listener, conn, "", ctx)
+
+	// a second proxy which retries, sharing the server started above
+	retryListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	retryProxy := Proxy{
+		Subject:   subject,
+		Transport: &Transport{Conn: conn, Retry: &RetryPolicy{}},
+		Listener:  retryListener,
+	}
+
+	go func() {
+		_ = retryProxy.Listen(ctx)
+	}()
+
+	for _, mode := range []string{"header", "raw", "retry"} {
+		t.Run(mode, func(t *testing.T) {
+			as := assert.New(t)
+
+			transport := &Transport{Conn: conn}
+			if mode == "retry" {
+				transport.Retry = &RetryPolicy{}
+			}
+
+			req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/echo?mode="+mode, nil)
+			as.Nil(err)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "echo")
+
+			resp, err := transport.RoundTrip(req)
+			as.Nil(err)
+			as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+			as.Equal("echo", resp.Header.Get("Upgrade"))
+
+			tunnel, ok := resp.Body.(io.ReadWriteCloser)
+			as.True(ok)
+
+			assertEcho(t, tunnel, 11)
+			assertEcho(t, tunnel, int(conn.MaxPayload())*3)
+
+			// once we stop writing the server closes the tunnel
+			as.Nil(tunnel.(interface{ CloseWrite() error }).CloseWrite())
+			_, err = tunnel.Read(make([]byte, 1))
+			as.ErrorIs(err, io.EOF)
+
+			as.Nil(tunnel.Close())
+		})
+	}
+
+	t.Run("not upgraded", func(t *testing.T) {
+		as := assert.New(t)
+
+		transport := &Transport{Conn: conn}
+
+		req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/echo", nil)
+		as.Nil(err)
+
+		resp, err := transport.RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusUpgradeRequired, resp.StatusCode)
+
+		req, err = http.NewRequest(http.MethodGet, "nats+http://"+subject+"/not-upgraded", nil)
+		as.Nil(err)
+
+		resp, err = transport.RoundTrip(req)
+		as.Nil(err)
+		as.Equal(http.StatusOK, resp.StatusCode)
+	})
+
+	for _, tc := range []struct {
+		name     string
+		listener net.Listener
+	}{
+		{"proxy", listener},
+		{"proxy with retry", retryListener},
+	} {
+		listener := tc.listener
+
+		t.Run(tc.name, func(t *testing.T) {
+			as := assert.New(t)
+
+			client, err := net.Dial("tcp", listener.Addr().String())
+			as.Nil(err)
+			defer func() { _ = client.Close() }()
+
+			_, err = fmt.Fprintf(client, "GET /echo HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", listener.Addr())
+			as.Nil(err)
+
+			reader := bufio.NewReader(client)
+			resp, err := http.ReadResponse(reader, nil)
+			as.Nil(err)
+			as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+			as.Equal("echo", resp.Header.Get("Upgrade"))
+			as.True(strings.EqualFold("upgrade", resp.Header.Get("Connection")))
+
+			assertEcho(t, struct {
+				io.Reader
+				io.Writer
+			}{reader, client}, int(conn.MaxPayload())*2)
+
+			// once the client stops writing the server closes the tunnel, and with it the connection
+			as.Nil(client.(*net.TCPConn).CloseWrite())
+			_, err = reader.ReadByte()
+			as.ErrorIs(err, io.EOF)
+		})
+	}
+
+	t.Run("proxy half-close", func(t *testing.T) {
+		as := assert.New(t)
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		as.Nil(err)
+		defer func() { _ = client.Close() }()
+
+		_, err = fmt.Fprintf(client, "GET /echo HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", listener.Addr())
+		as.Nil(err)
+
+		reader := bufio.NewReader(client)
+		resp, err := http.ReadResponse(reader, nil)
+		as.Nil(err)
+		as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+
+		data := make([]byte, int(conn.MaxPayload())*4)
+		_, err = rand.Read(data)
+		as.Nil(err)
+
+		// the client stops writing straight away, before anything has been echoed
+		go func() {
+			_, err := client.Write(data)
+			assert.Nil(t, err)
+			assert.Nil(t, client.(*net.TCPConn).CloseWrite())
+		}()
+
+		// everything is echoed before the server closes the tunnel
+		echoed, err := io.ReadAll(reader)
+		as.Nil(err)
+		as.Equal(data, echoed)
+	})
+}
+
+func TestTunnel_FlowControl(t *testing.T) {
+	s := runBasicNatsServer(t)
+	defer shutdownNatsServer(t, s)
+	conn := client(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the server does not read anything until released
+	release := make(chan struct{})
+
+	srv := &Server{
+		Conn:        conn,
+		Subject:     subject,
+		ChunkWindow: 2,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			assert.Nil(t, err)
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+				<-release
+				_, _ = io.Copy(conn, brw)
+			}()
+		}),
+	}
+
+	go func() {
+		_ = srv.Listen(ctx)
+	}()
+
+	waitForResponders(t, conn)
+
+	as := assert.New(t)
+
+	req, err := http.NewRequest(http.MethodGet, "nats+http://"+subject+"/echo", nil)
+	as.Nil(err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+
+	resp, err := (&Transport{Conn: conn}).RoundTrip(req)
+	as.Nil(err)
+	as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+
+	tunnel := resp.Body.(net.Conn)
+	defer func() { _ = tunnel.Close() }()
+
+	data := make([]byte, int(conn.MaxPayload())*8)
+	_, err = rand.Read(data)
+	as.Nil(err)
+
+	// the writer is blocked once the window of the server has been filled
+	as.Nil(tunnel.SetWriteDeadline(time.Now().Add(500 * time.Millisecond)))
+	n, err := tunnel.Write(data)
+	as.ErrorIs(err, os.ErrDeadlineExceeded)
+	as.LessOrEqual(n, int(conn.MaxPayload())*2)
+
+	// and resumes once the server consumes the chunks
+	as.Nil(tunnel.SetWriteDeadline(time.Time{}))
+	close(release)
+
+	go func() {
+		_, err := tunnel.Write(data[n:])
+		assert.Nil(t, err)
+		assert.Nil(t, tunnel.(interface{ CloseWrite() error }).CloseWrite())
+	}()
+
+	echoed, err := io.ReadAll(tunnel)
+	as.Nil(err)
+	as.Equal(data, echoed)
+}
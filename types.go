@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nats-io/nats.go"
 
@@ -17,7 +19,32 @@ const (
 	HeaderFragment   = "X-Fragment"
 	HeaderStatus     = "X-Status"
 	HeaderStatusCode = "X-Status-Code"
+	HeaderTimeout    = "X-Timeout"
 	UrlScheme        = "nats+http"
+
+	// headers used for flow control of chunk streams
+	HeaderChunkWindow     = "X-Chunk-Window"
+	HeaderChunkAck        = "X-Chunk-Ack"
+	HeaderChunkAckSubject = "X-Chunk-Ack-Subject"
+	HeaderChunkClosed     = "X-Chunk-Closed"
+
+	// headers used for verifying the integrity of chunk streams
+	HeaderChunkSeq      = "X-Chunk-Seq"
+	HeaderChunkChecksum = "X-Chunk-Checksum"
+
+	// header used by a sender to abort a chunk stream, with the value describing the reason
+	HeaderChunkAbort = "X-Chunk-Abort"
+
+	// header used by a client to announce the subject on which it will cancel the request if it is abandoned
+	HeaderCancelSubject = "X-Cancel-Subject"
+
+	// headers used for negotiating the compression of bodies on the wire
+	HeaderAcceptCompression = "X-Accept-Compression"
+	HeaderCompression       = "X-Compression"
+
+	// status header and code used by the nats server to indicate there are no responders for a request
+	natsStatusHeader     = "Status"
+	natsNoRespondersCode = "503"
 )
 
 type Result[T any] struct {
@@ -56,6 +83,10 @@ func ReqToMsg(req *http.Request, msg *nats.Msg) error {
 	return nil
 }
 
+func isNoResponders(msg *nats.Msg) bool {
+	return len(msg.Data) == 0 && msg.Header.Get(natsStatusHeader) == natsNoRespondersCode
+}
+
 func MsgToRequest(prefix string, msg *nats.Msg, req *http.Request) error {
 	subject := msg.Subject
 
@@ -74,6 +105,8 @@ func MsgToRequest(prefix string, msg *nats.Msg, req *http.Request) error {
 	}
 
 	req.Proto = "HTTP/1.1"
+	req.ProtoMajor = 1
+	req.ProtoMinor = 1
 
 	h := msg.Header
 
@@ -86,5 +119,25 @@ func MsgToRequest(prefix string, msg *nats.Msg, req *http.Request) error {
 		RawFragment: h.Get(HeaderFragment),
 	}
 
+	req.Host = prefix
+	req.RequestURI = req.URL.RequestURI()
+
 	return nil
 }
+
+// formatTimeout encodes the time remaining until a deadline. A relative duration is used rather than an absolute
+// timestamp to avoid problems with clock skew between the client and server.
+func formatTimeout(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Annotatef(err, "natshttp: invalid %s header '%s'", HeaderTimeout, value)
+	}
+	return d, nil
+}